@@ -0,0 +1,224 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+)
+
+var (
+	checkTypes = map[string]pb.CheckType{
+		"http":  pb.CheckType_HTTP,
+		"https": pb.CheckType_HTTPS,
+		"tcp":   pb.CheckType_TCP,
+		"dns":   pb.CheckType_DNS,
+	}
+	errCheckArgs     = errors.New("Expected input in form [type] host [options]")
+	errCheckOption   = errors.New("Unknown check option")
+	errDnsRecordType = errors.New("Unsupported DNS record type")
+	errRedirects     = errors.New("Number of redirects must not be negative")
+
+	assertionStates = map[pb.AssertionState]string{
+		pb.AssertionState_ASSERTION_PASSED: "passed",
+		pb.AssertionState_ASSERTION_FAILED: "failed",
+	}
+)
+
+// Builds a check request from the user input in the form "[type] host [options]", plain http check is used if type is omitted
+// TCP checks expect the host in form host:port, DNS checks may be followed by a list of record types to resolve
+// and HTTP(S) checks by key=value options, a full URL may be given instead of the host for HTTP(S) checks
+func ParseCheck(args []string) (*pb.CheckHostRequest, error) {
+	check := &pb.CheckHostRequest{Type: pb.CheckType_HTTP}
+	if len(args) > 0 {
+		if checkType, ok := checkTypes[args[0]]; ok {
+			check.Type = checkType
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return nil, errCheckArgs
+	}
+	check.Host = args[0]
+	options := args[1:]
+
+	switch check.Type {
+	case pb.CheckType_DNS:
+		for _, arg := range options {
+			recordType, ok := pb.DnsRecordType_value[strings.ToUpper(arg)]
+			if !ok {
+				return nil, errDnsRecordType
+			}
+			check.RecordTypes = append(check.RecordTypes, pb.DnsRecordType(recordType))
+		}
+	case pb.CheckType_TCP:
+		if len(options) > 0 {
+			return nil, errCheckArgs
+		}
+		host, port, err := net.SplitHostPort(check.Host)
+		if err != nil {
+			return nil, err
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		check.Host, check.Port = host, int32(portNum)
+	default:
+		if strings.Contains(check.Host, "://") {
+			target, err := url.Parse(check.Host)
+			if err != nil {
+				return nil, err
+			}
+			check.Url, check.Host = target.String(), target.Hostname() // older peers only understand the host
+			if target.Scheme == "https" {
+				check.Type = pb.CheckType_HTTPS
+			} else {
+				check.Type = pb.CheckType_HTTP
+			}
+		}
+		for _, option := range options {
+			if err := parseHttpOption(check, option); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return check, nil
+}
+
+// Applies an option of an HTTP(S) check given in the form key=value
+func parseHttpOption(check *pb.CheckHostRequest, option string) error {
+	key, value, ok := strings.Cut(option, "=")
+	if !ok {
+		return errCheckOption
+	}
+	switch key {
+	case "method", "header", "redirects":
+		if check.Http == nil {
+			check.Http = &pb.HttpOptions{}
+		}
+	case "contains", "regex", "sha256":
+		if check.Assertions == nil {
+			check.Assertions = &pb.Assertions{}
+		}
+	}
+
+	switch key {
+	case "method":
+		check.Http.Method = strings.ToUpper(value)
+	case "header":
+		name, headerValue, ok := strings.Cut(value, ":")
+		if !ok {
+			return errCheckOption
+		}
+		check.Http.Headers = append(check.Http.Headers, &pb.Header{Name: name, Value: headerValue})
+	case "redirects":
+		if value == "none" {
+			check.Http.RedirectPolicy = pb.RedirectPolicy_REDIRECT_NONE
+			break
+		}
+		if value == "follow" {
+			check.Http.RedirectPolicy = pb.RedirectPolicy_REDIRECT_FOLLOW
+			break
+		}
+		maxRedirects, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if maxRedirects < 0 {
+			return errRedirects
+		}
+		if maxRedirects == 0 { // zero hops in the request mean the probe's default
+			check.Http.RedirectPolicy = pb.RedirectPolicy_REDIRECT_NONE
+			break
+		}
+		check.Http.MaxRedirects = int32(maxRedirects)
+	case "contains":
+		check.Assertions.Substring = value
+	case "regex":
+		check.Assertions.Regex = value
+	case "sha256":
+		hash, err := hex.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		check.Assertions.BodySha256 = hash
+	default:
+		return errCheckOption
+	}
+	return nil
+}
+
+// Returns what is checked in a human-readable form
+func checkTarget(check *pb.CheckHostRequest) string {
+	if check.GetUrl() != "" {
+		return check.GetUrl()
+	}
+	if check.GetType() == pb.CheckType_TCP {
+		return net.JoinHostPort(check.GetHost(), strconv.Itoa(int(check.GetPort())))
+	}
+	return check.GetHost()
+}
+
+// Returns a comparable representation of the probe's answer which is used in voting
+func answerKey(r *pb.CheckHostResponse) string {
+	status := r.GetStatus()
+	if status != pb.CheckStatus_OK && status != pb.CheckStatus_HTTP_ERROR && r.GetTcp() == nil {
+		return status.String()
+	}
+	return fmt.Sprintf("%s %s", status, answerDetails(r))
+}
+
+func answerDetails(r *pb.CheckHostResponse) string {
+	if dns := r.GetDns(); dns != nil { // TTLs decrease over time so only the answer sets are compared
+		answers := make([]string, 0, len(dns.GetAnswers()))
+		for _, answer := range dns.GetAnswers() {
+			records := make([]string, 0, len(answer.GetRecords()))
+			for _, record := range answer.GetRecords() {
+				records = append(records, fmt.Sprintf("%s %s", record.GetType(), record.GetValue()))
+			}
+			answers = append(answers, fmt.Sprintf("%s %s %v", answer.GetType(), answer.GetRcode(), records))
+		}
+		return strings.Join(answers, "; ")
+	}
+	if tcp := r.GetTcp(); tcp != nil { // latency differs between probes so it is not a part of the answer
+		return fmt.Sprintf("connected: %t (%s)", tcp.GetConnected(), tcp.GetError())
+	}
+
+	key := fmt.Sprintf("%d", r.GetCode())
+	if tls := r.GetTls(); tls != nil {
+		// days to expiry depend on the clock of the probe and the moment of the check, so they are not a part of the answer either
+		key += fmt.Sprintf(" (%s, valid chain: %t, issuer: %s)", tls.GetVersion(), tls.GetChainValid(), tls.GetIssuer())
+	}
+	if len(r.GetRedirects()) > 0 {
+		hops := make([]string, 0, len(r.GetRedirects()))
+		for _, hop := range r.GetRedirects() {
+			hops = append(hops, fmt.Sprintf("%d %s", hop.GetCode(), hop.GetLocation()))
+		}
+		key += fmt.Sprintf(" via %v", hops)
+	}
+	if assertions := r.GetAssertions(); assertions != nil {
+		key += " " + assertionsKey(assertions)
+	}
+	return key
+}
+
+// Dynamic pages differ between requests so the body hash is only compared when the client expects a specific one
+func assertionsKey(assertions *pb.AssertionResults) string {
+	results := make([]string, 0)
+	if state, ok := assertionStates[assertions.GetSubstring()]; ok {
+		results = append(results, "substring "+state)
+	}
+	if state, ok := assertionStates[assertions.GetRegex()]; ok {
+		results = append(results, "regex "+state)
+	}
+	if state, ok := assertionStates[assertions.GetBodySha256()]; ok {
+		results = append(results, fmt.Sprintf("sha256 %s (body %x)", state, assertions.GetBodyHash()))
+	}
+	return fmt.Sprintf("%v", results)
+}
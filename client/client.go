@@ -1,7 +1,9 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"log"
 	"time"
 
@@ -11,10 +13,27 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
 	pickProbes = 3
+
+	// All probes are queried in parallel and must answer within this time
+	checkTimeout = 30 * time.Second
+
+	// Statuses that tell nothing about the target and are not counted as votes
+	nonVotingStatuses = map[pb.CheckStatus]bool{
+		pb.CheckStatus_POLICY_REFUSED:      true,
+		pb.CheckStatus_INVALID_REQUEST:     true,
+		pb.CheckStatus_PROBE_UNREACHABLE:   true,
+		pb.CheckStatus_BAD_SIGNATURE:       true,
+		pb.CheckStatus_MISMATCHED_RESPONSE: true,
+	}
+
+	errResponseRequest = errors.New("Response answers another request")
+	errResponseHost    = errors.New("Response is for another host")
+	errResponseTime    = errors.New("Response was made outside of the request validity")
 )
 
 type Node struct {
@@ -23,88 +42,206 @@ type Node struct {
 
 type PingerClient struct {
 	RepManager reputation.ReputationManagerInterface
-	user       identity.PrivateUser
+	// If positive, failed reputable probes are replaced with other candidates until this many reputable probes give valid answers
+	Quorum int
+	// If set, every probe votes with its weight from the reputation manager instead of reputable probes voting equally
+	Weighted bool
+	// No verdict is declared if the confidence of the vote is below this value
+	MinConfidence float64
+	user          identity.PrivateUser
+}
+
+func failedResult(probe reputation.Probe, status pb.CheckStatus, err error) ProbeResult {
+	return ProbeResult{
+		Id:        probe.User.Id,
+		Address:   probe.User.Address,
+		Reputable: probe.Reputable,
+		Status:    status,
+		Answer:    status.String(),
+		Err:       err,
+	}
 }
 
 func (pingerClient *PingerClient) SetUser(user identity.PrivateUser) {
 	pingerClient.user = user
 }
 
-func (pingerClient *PingerClient) GetStatus(host string) {
-	// TODO: At this moment we get exactly pickProbes probes and if some of them don't answer we have fewer probes to vote
-	probes := pingerClient.RepManager.GetProbes(pingerClient.user, pickProbes)
+func (pingerClient *PingerClient) queryProbe(ctx context.Context, probe reputation.Probe, check *pb.CheckHostRequest) (result ProbeResult) {
+	start := time.Now()
+	defer func() {
+		result.Latency = time.Since(start)
+	}()
 
-	results := make([]int32, 0, len(probes))
-	resultsToPrint := make([]int32, 0)
-	aggResults := make(map[int32]int)
+	conn, err := grpc.Dial(probe.User.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return failedResult(probe, pb.CheckStatus_PROBE_UNREACHABLE, err)
+	}
+	defer conn.Close()
+	c := pb.NewPingerClient(conn)
+
+	message := proto.Clone(check).(*pb.CheckHostRequest)
+	message.Sender = pingerClient.user.Id
+	now := time.Now()
+	message.IssuedAt, message.ExpiresAt = now.UnixMilli(), now.Add(identity.RequestLifetime).UnixMilli()
+	message.Nonce = identity.NewNonce()
+	message.Recipient = probe.User.Id
+	requestHash, err := identity.HashProto(message)
+	if err != nil {
+		log.Fatalf("cannot hash message: %v", err)
+	}
+	signature, err := identity.SignProto(pingerClient.user, message)
+	if err != nil {
+		log.Fatalf("cannot sign message: %v", err)
+	}
+	message.Signature = signature
 
-	var bestAns int32 = 0
-	for _, probe := range probes {
-		if probe.Reputable {
-			log.Printf("Using probe: %v", probe.User.Address)
-		} else {
-			log.Printf("Using quarantined probe: %v", probe.User.Address)
-		}
+	r, err := c.CheckHost(ctx, message)
+	if err != nil {
+		return failedResult(probe, pb.CheckStatus_PROBE_UNREACHABLE, err)
+	}
+	signature = r.Signature
+	r.Signature = nil
+	err = identity.VerifyProto(probe.User, r, signature)
+	if err != nil {
+		return failedResult(probe, pb.CheckStatus_BAD_SIGNATURE, err)
+	}
+	err = matchResponse(message, requestHash, r)
+	if err != nil {
+		return failedResult(probe, pb.CheckStatus_MISMATCHED_RESPONSE, err)
+	}
 
-		conn, err := grpc.Dial(probe.User.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
-		if err != nil {
-			log.Printf("Cannot not connect: %v", err)
-			continue
-		}
-		defer conn.Close()
-		c := pb.NewPingerClient(conn)
+	return ProbeResult{
+		Id:        probe.User.Id,
+		Address:   probe.User.Address,
+		Reputable: probe.Reputable,
+		Status:    r.GetStatus(),
+		Answer:    answerKey(r),
+		Code:      r.GetCode(),
+		Response:  r,
+	}
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+// Makes sure that a signed response was given to the request and not replayed from an earlier one
+func matchResponse(request *pb.CheckHostRequest, requestHash []byte, r *pb.CheckHostResponse) error {
+	if !bytes.Equal(r.GetRequestHash(), requestHash) {
+		return errResponseRequest
+	}
+	if r.GetHost() != request.GetHost() {
+		return errResponseHost
+	}
+	checkedAt := time.UnixMilli(r.GetCheckedAt())
+	if checkedAt.Before(time.UnixMilli(request.GetIssuedAt()).Add(-identity.ClockSkew)) || checkedAt.After(time.UnixMilli(request.GetExpiresAt())) {
+		return errResponseTime
+	}
+	return nil
+}
 
-		message := pb.CheckHostRequest{Host: host, Sender: pingerClient.user.Id}
-		signature, err := identity.SignProto(pingerClient.user, &message)
-		if err != nil {
-			log.Fatalf("cannot sign message: %v", err)
-		}
-		message.Signature = signature
-
-		r, err := c.CheckHost(ctx, &message)
-		var code int32
-		if err != nil {
-			log.Printf("error during probe request: %v", err)
-			code = 0
-		} else {
-			signature := r.Signature
-			r.Signature = nil
-			err = identity.VerifyProto(probe.User, r, signature)
-			if err != nil {
-				code = 0
-			} else {
-				code = r.GetCode()
-			}
+// Asks probes to check the target and votes on their answers, reputations of the probes are updated with the outcome
+// If ctx is done before the check completes, its error is returned and reputations are left untouched
+func (pingerClient *PingerClient) GetStatus(ctx context.Context, check *pb.CheckHostRequest) (*CheckResult, error) {
+	var probes []reputation.Probe
+	replacements := make([]reputation.Probe, 0) // reputable probes that are used if selected ones fail
+	if pingerClient.Quorum > 0 {
+		pool := pingerClient.RepManager.GetProbePool(pingerClient.user)
+		selected := pingerClient.Quorum
+		if len(pool.Reputable) < selected {
+			selected = len(pool.Reputable)
 		}
+		probes = append(pool.Reputable[:selected:selected], pool.Quarantined...)
+		replacements = pool.Reputable[selected:]
+	} else {
+		probes = pingerClient.RepManager.GetProbes(pingerClient.user, pickProbes)
+	}
 
-		results = append(results, code)
-		if probe.Reputable { // update best answer if probe is reputable
-			resultsToPrint = append(resultsToPrint, code)
+	checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
 
-			aggResults[code] += 1
-			if aggResults[code] > aggResults[bestAns] {
-				bestAns = code
-			}
-		}
+	type indexedAnswer struct {
+		index  int
+		answer ProbeResult
+	}
+	arrived := make(chan indexedAnswer)
+	pending := 0
+	ask := func(i int, probe reputation.Probe) {
+		pending++
+		go func() {
+			arrived <- indexedAnswer{index: i, answer: pingerClient.queryProbe(checkCtx, probe, check)}
+		}()
+	}
+	for i, probe := range probes {
+		ask(i, probe)
 	}
 
-	if bestAns != 0 { // At the moment 0 means that some kind of problem was encountered during ping process, we don't want to rate nodes if most of them are faulty
-		satisfied := make([]int, 0, len(results))
-		for _, code := range results {
-			if code == bestAns {
-				satisfied = append(satisfied, 1)
-			} else {
-				satisfied = append(satisfied, -1)
+	result := &CheckResult{Target: checkTarget(check), Votes: make(map[string]float64)}
+	answers := make([]ProbeResult, len(probes)) // answers are kept in the order of probes for EvaluateVotes
+	for ; pending > 0; pending-- {              // every query finishes by the deadline of checkCtx
+		arrival := <-arrived
+		answer := arrival.answer
+
+		if nonVotingStatuses[answer.Status] {
+			answers[arrival.index] = answer
+			if answer.Reputable && len(replacements) > 0 && checkCtx.Err() == nil {
+				probes = append(probes, replacements[0])
+				answers = append(answers, ProbeResult{})
+				replacements = replacements[1:]
+				ask(len(probes)-1, probes[len(probes)-1])
 			}
+			continue
+		}
+		if pingerClient.Weighted {
+			answer.Weight = probes[arrival.index].Weight
+		} else if answer.Reputable {
+			answer.Weight = 1
 		}
+		answers[arrival.index] = answer
+		if answer.Weight > 0 {
+			result.Votes[answer.Answer] += answer.Weight
+		}
+	}
+	result.Verdict, result.Confidence = tally(result.Votes)
+	if result.Confidence < pingerClient.MinConfidence {
+		result.Verdict = ""
+	}
+	if err := ctx.Err(); err != nil { // answers are incomplete through no fault of the probes
+		return nil, err
+	}
 
-		pingerClient.RepManager.EvaluateVotes(probes, satisfied) // usage of append inside EvaluateVotes will ruin probes[0]
+	satisfied := make([]int, 0, len(answers))
+	for _, answer := range answers {
+		switch {
+		case answer.Status == pb.CheckStatus_BAD_SIGNATURE, answer.Status == pb.CheckStatus_MISMATCHED_RESPONSE: // probe misbehaves regardless of the vote
+			satisfied = append(satisfied, -1)
+		case nonVotingStatuses[answer.Status] || !result.Known(): // nothing to compare with
+			satisfied = append(satisfied, 0)
+		case answer.Answer == result.Verdict:
+			satisfied = append(satisfied, 1)
+		default:
+			satisfied = append(satisfied, -1)
+		}
 	}
+	pingerClient.RepManager.EvaluateVotes(probes, satisfied) // usage of append inside EvaluateVotes will ruin probes[0]
+
+	result.Probes = answers
+	return result, nil
+}
 
-	log.Printf("Check result for host %s: %v", host, resultsToPrint) // only print results by reputable probes
-	log.Printf("Aggregated results: %v", aggResults)
-	log.Printf("Resource status: %d", bestAns)
+// Returns the answer with the most votes and its winning margin over the runner-up as a share of all votes
+func tally(votes map[string]float64) (string, float64) {
+	best, total := "", 0.0
+	for answer, weight := range votes {
+		total += weight
+		if weight > votes[best] || (weight == votes[best] && answer < best) { // ties are broken the same way on every run
+			best = answer
+		}
+	}
+	if best == "" {
+		return "", 0
+	}
+	runnerUp := 0.0
+	for answer, weight := range votes {
+		if answer != best && weight > runnerUp {
+			runnerUp = weight
+		}
+	}
+	return best, (votes[best] - runnerUp) / total
 }
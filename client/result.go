@@ -0,0 +1,63 @@
+package client
+
+import (
+	"time"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+)
+
+// Answer of a single probe to a check
+type ProbeResult struct {
+	Id        string
+	Address   string
+	Reputable bool
+	Status    pb.CheckStatus
+	Answer    string        // comparable representation of the answer used in voting
+	Code      int32         // HTTP status code, 0 for other check types
+	Latency   time.Duration // round trip of the query as seen by the client
+	Err       error         // reason why the probe did not give a valid answer
+	Weight    float64       // weight of the probe's vote, 0 if it did not vote
+	Response  *pb.CheckHostResponse
+}
+
+// Outcome of a check across all asked probes
+type CheckResult struct {
+	Target  string
+	Verdict string // answer with the most votes, empty if nobody voted or the confidence is below the required minimum
+	// Confidence is the margin of the winning answer over the runner-up as a share of all votes
+	Confidence float64
+	Votes      map[string]float64 // total weight of the probes that gave every valid answer
+	Probes     []ProbeResult      // in the order the probes were asked
+}
+
+func (result *CheckResult) Known() bool {
+	return result.Verdict != ""
+}
+
+// Number of reputable probes that gave valid answers
+func (result *CheckResult) ValidAnswers() int {
+	total := 0
+	for _, probe := range result.Probes {
+		if probe.Reputable && !nonVotingStatuses[probe.Status] {
+			total++
+		}
+	}
+	return total
+}
+
+// Formats min/median/p95 of the timings reported by reputable probes with valid answers, empty if there are none
+func (result *CheckResult) TimingsSummary() string {
+	timings := make([]*pb.Timings, 0)
+	for _, probe := range result.Probes {
+		if !probe.Reputable || nonVotingStatuses[probe.Status] {
+			continue
+		}
+		if t := responseTimings(probe.Response); t != nil {
+			timings = append(timings, t)
+		}
+	}
+	if len(timings) == 0 {
+		return ""
+	}
+	return summarizeTimings(timings)
+}
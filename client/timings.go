@@ -0,0 +1,52 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+)
+
+// Returns the timings reported by the probe, TCP checks only have a connect phase
+func responseTimings(r *pb.CheckHostResponse) *pb.Timings {
+	if tcp := r.GetTcp(); tcp != nil {
+		return &pb.Timings{ConnectMicros: tcp.GetLatencyMicros(), TotalMicros: tcp.GetLatencyMicros()}
+	}
+	return r.GetTimings()
+}
+
+// Nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Formats min/median/p95 of every request phase across the given timings
+func summarizeTimings(timings []*pb.Timings) string {
+	phases := []struct {
+		name  string
+		value func(*pb.Timings) int64
+	}{
+		{"dns", (*pb.Timings).GetDnsMicros},
+		{"connect", (*pb.Timings).GetConnectMicros},
+		{"tls", (*pb.Timings).GetTlsMicros},
+		{"ttfb", (*pb.Timings).GetTtfbMicros},
+		{"total", (*pb.Timings).GetTotalMicros},
+	}
+
+	summary := make([]string, 0, len(phases))
+	for _, phase := range phases {
+		durations := make([]time.Duration, 0, len(timings))
+		for _, t := range timings {
+			durations = append(durations, time.Duration(phase.value(t))*time.Microsecond)
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		summary = append(summary, fmt.Sprintf("%s %v/%v/%v", phase.name, durations[0], percentile(durations, 50), percentile(durations, 95)))
+	}
+	return strings.Join(summary, ", ")
+}
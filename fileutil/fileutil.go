@@ -0,0 +1,30 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Replaces the file with data, a crash during the write never leaves a partially written file
+// The file is readable only by its owner
+func WriteAtomic(path string, data []byte) error {
+	fi, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp") // created with 0600 permissions
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fi.Name()) // does nothing after a successful rename
+
+	_, err = fi.Write(data)
+	if err == nil {
+		err = fi.Sync()
+	}
+	if err != nil {
+		fi.Close()
+		return err
+	}
+	err = fi.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(fi.Name(), path)
+}
@@ -0,0 +1,82 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// scrypt parameters for new key files, about 100 ms and 32 MiB per derivation
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeySize = 32 // AES-256
+	saltSize      = 16
+
+	errPassphrase = errors.New("Wrong passphrase or damaged user file")
+)
+
+// Private key sealed with AES-GCM under a key derived from a passphrase with scrypt
+type encryptedKey struct {
+	Kdf        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func keyCipher(passphrase string, salt []byte, n int, r int, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, scryptKeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts the marshaled private key, the ID is authenticated along with it so the key cannot be moved to another ID
+func encryptKey(privateKey []byte, id string, passphrase string) (*encryptedKey, error) {
+	sealed := &encryptedKey{Kdf: "scrypt", Salt: make([]byte, saltSize), N: scryptN, R: scryptR, P: scryptP}
+	_, err := rand.Read(sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := keyCipher(passphrase, sealed.Salt, sealed.N, sealed.R, sealed.P)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(sealed.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, privateKey, []byte(id))
+	return sealed, nil
+}
+
+func decryptKey(sealed *encryptedKey, id string, passphrase string) ([]byte, error) {
+	if sealed.Kdf != "scrypt" {
+		return nil, errors.New("Unsupported key derivation function")
+	}
+	aead, err := keyCipher(passphrase, sealed.Salt, sealed.N, sealed.R, sealed.P)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, errPassphrase
+	}
+	privateKey, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, []byte(id))
+	if err != nil {
+		return nil, errPassphrase
+	}
+	return privateKey, nil
+}
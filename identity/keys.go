@@ -0,0 +1,91 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+)
+
+const (
+	KeyEd25519 = "ed25519"
+	KeyRsa     = "rsa" // fallback for environments without Ed25519
+)
+
+var (
+	rsaKeySize = 3072
+
+	// IDs without a key type are legacy ones with small RSA keys, they are refused unless the operator allows them
+	allowLegacyKeys = false
+
+	errKeyType   = errors.New("Unsupported key type")
+	errLegacyKey = errors.New("Legacy RSA key is too small")
+)
+
+// Makes ParseUser accept legacy IDs with RSA keys smaller than 3072 bits, which can be factored
+func SetAllowLegacyKeys(allow bool) {
+	if allow {
+		log.Printf("Warning: legacy IDs with weak RSA keys are accepted, their keys can be forged")
+	}
+	allowLegacyKeys = allow
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyEd25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	case KeyRsa:
+		return rsa.GenerateKey(rand.Reader, rsaKeySize)
+	default:
+		return nil, errKeyType
+	}
+}
+
+// Encodes the public key for the ID as its type followed by the base64 of the key
+func encodePublicKey(publicKey crypto.PublicKey) (string, error) {
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		return KeyEd25519 + ":" + base64.StdEncoding.EncodeToString(key), nil
+	case *rsa.PublicKey:
+		return KeyRsa + ":" + base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(key)), nil
+	default:
+		return "", errKeyType
+	}
+}
+
+// Decodes the public key from the ID, keys without a type are legacy RSA keys
+func decodePublicKey(encoded string) (crypto.PublicKey, error) {
+	keyType, keyString, typed := strings.Cut(encoded, ":")
+	if !typed {
+		keyType, keyString = KeyRsa, encoded
+	}
+	marshaled, err := base64.StdEncoding.DecodeString(keyString)
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyType {
+	case KeyEd25519:
+		if len(marshaled) != ed25519.PublicKeySize {
+			return nil, errKeyType
+		}
+		return ed25519.PublicKey(marshaled), nil
+	case KeyRsa:
+		key, err := x509.ParsePKCS1PublicKey(marshaled)
+		if err != nil {
+			return nil, err
+		}
+		if key.Size()*8 < rsaKeySize && !allowLegacyKeys {
+			return nil, errLegacyKey
+		}
+		return key, nil
+	default:
+		return nil, errKeyType
+	}
+}
@@ -2,28 +2,69 @@ package identity
 
 import (
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 )
 
 var (
 	signatureHash = crypto.SHA256
+	nonceSize     = 16
+
+	errSignature = errors.New("Bad signature")
+)
+
+const (
+	// Signed requests expire this long after they are issued, nodes refuse requests with longer lifetimes
+	RequestLifetime = time.Minute
+	// Clocks of nodes may differ by this much, requests issued a bit in the future are accepted
+	ClockSkew = 30 * time.Second
 )
 
-func sign(privateKey *rsa.PrivateKey, message []byte) ([]byte, error) {
-	hasher := signatureHash.New()
-	hasher.Write(message)
-	signature, err := rsa.SignPSS(rand.Reader, privateKey, signatureHash, hasher.Sum(nil), nil)
-	return signature, err
+// Random value that makes every signed request unique
+func NewNonce() []byte {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		log.Fatalf("cannot generate nonce: %v", err)
+	}
+	return nonce
 }
 
-func verify(publicKey *rsa.PublicKey, message []byte, signature []byte) error {
-	hasher := signatureHash.New()
-	hasher.Write(message)
-	err := rsa.VerifyPSS(publicKey, signatureHash, hasher.Sum(nil), signature, nil)
-	return err
+// RSA keys sign the SHA-256 of the message with PSS, Ed25519 keys sign the message itself
+func sign(privateKey crypto.Signer, message []byte) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, message), nil
+	case *rsa.PrivateKey:
+		hasher := signatureHash.New()
+		hasher.Write(message)
+		return rsa.SignPSS(rand.Reader, key, signatureHash, hasher.Sum(nil), nil)
+	default:
+		return nil, errKeyType
+	}
+}
+
+func verify(publicKey crypto.PublicKey, message []byte, signature []byte) error {
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, signature) {
+			return errSignature
+		}
+		return nil
+	case *rsa.PublicKey:
+		hasher := signatureHash.New()
+		hasher.Write(message)
+		return rsa.VerifyPSS(key, signatureHash, hasher.Sum(nil), signature, nil)
+	default:
+		return errKeyType
+	}
 }
 
 func SignProto(user PrivateUser, message proto.Message) ([]byte, error) {
@@ -34,6 +75,16 @@ func SignProto(user PrivateUser, message proto.Message) ([]byte, error) {
 	return sign(user.privateKey, serialized)
 }
 
+// Hash of the serialized message, used to tie an answer to the message it answers
+func HashProto(message proto.Message) ([]byte, error) {
+	serialized, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(serialized)
+	return hash[:], nil
+}
+
 func VerifyProto(user PublicUser, message proto.Message, signature []byte) error {
 	serialized, err := proto.Marshal(message)
 	if err != nil {
@@ -0,0 +1,76 @@
+package identity
+
+import "errors"
+
+var (
+	errSuccessionSelf = errors.New("Succession must lead to another ID")
+)
+
+// Record of a key rotation: the old key hands the reputation of the old ID over to the new ID
+// The new key countersigns it, so that nobody can push the ratings of a badly rated ID onto another node
+type Succession struct {
+	OldId        string `json:"oldid"`
+	NewId        string `json:"newid"`
+	Signature    []byte `json:"signature"`    // made by the old key
+	NewSignature []byte `json:"newsignature"` // made by the new key
+}
+
+func successionMessage(oldId string, newId string) []byte {
+	return []byte("dist-pinger succession\n" + oldId + "\n" + newId)
+}
+
+// Signs over the reputation of the old user to the new one, both keys sign the succession
+func NewSuccession(old PrivateUser, new PrivateUser) (Succession, error) {
+	if old.Id == new.Id {
+		return Succession{}, errSuccessionSelf
+	}
+	message := successionMessage(old.Id, new.Id)
+	signature, err := sign(old.privateKey, message)
+	if err != nil {
+		return Succession{}, err
+	}
+	newSignature, err := sign(new.privateKey, message)
+	if err != nil {
+		return Succession{}, err
+	}
+	return Succession{OldId: old.Id, NewId: new.Id, Signature: signature, NewSignature: newSignature}, nil
+}
+
+// Checks that both IDs are valid and both keys signed the succession, returns the old and the new user
+func (s Succession) Verify() (PublicUser, PublicUser, error) {
+	if s.OldId == s.NewId {
+		return PublicUser{}, PublicUser{}, errSuccessionSelf
+	}
+	oldUser, err := ParseUser(s.OldId)
+	if err != nil {
+		return PublicUser{}, PublicUser{}, err
+	}
+	newUser, err := ParseUser(s.NewId)
+	if err != nil {
+		return PublicUser{}, PublicUser{}, err
+	}
+	message := successionMessage(s.OldId, s.NewId)
+	err = verify(oldUser.publicKey, message, s.Signature)
+	if err != nil {
+		return PublicUser{}, PublicUser{}, err
+	}
+	err = verify(newUser.publicKey, message, s.NewSignature)
+	if err != nil {
+		return PublicUser{}, PublicUser{}, err
+	}
+	return oldUser, newUser, nil
+}
+
+// Generates a new user that succeeds the old one, the address stays the same
+func RotateUser(old PrivateUser, keyType string, work int) (PrivateUser, error) {
+	user, err := GenUser(old.Address, keyType, work)
+	if err != nil {
+		return PrivateUser{}, err
+	}
+	succession, err := NewSuccession(old, user)
+	if err != nil {
+		return PrivateUser{}, err
+	}
+	user.Predecessor = &succession
+	return user, nil
+}
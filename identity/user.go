@@ -1,88 +1,152 @@
 package identity
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/bits"
 	"os"
 	"regexp"
+	"strconv"
+
+	"github.com/rybbba/dist-pinger/fileutil"
 )
 
 var (
-	userKeySize = 512
+	// IDs with less proof of work are rejected by ParseUser
+	minWork = 0
 )
 
 type PrivateUser struct {
-	Id         string
-	Address    string
-	privateKey *rsa.PrivateKey
+	Id          string
+	Address     string
+	Predecessor *Succession // hands the reputation of the previous ID of the user over to this one
+	privateKey  crypto.Signer
 }
 
 type PublicUser struct {
 	Id        string
 	Address   string
-	publicKey *rsa.PublicKey
+	Work      int // number of leading zero bits in the hash of the ID
+	publicKey crypto.PublicKey
 }
 
 type privateUserFile struct {
-	Id         string `json:"id"`
-	Address    string `json:"address"`
-	PrivateKey []byte `json:"privatekey"`
+	Id           string        `json:"id"`
+	Address      string        `json:"address"`
+	PrivateKey   []byte        `json:"privatekey,omitempty"` // unencrypted PKCS #8, files of legacy users hold a PKCS #1 RSA key
+	EncryptedKey *encryptedKey `json:"encryptedkey,omitempty"`
+	Predecessor  *Succession   `json:"predecessor,omitempty"`
 }
 
-func WriteUser(user PrivateUser, path string) error {
-	fi, err := os.Create(path)
+// Writes the user to a file readable only by its owner, the private key is encrypted unless the passphrase is empty
+func WriteUser(user PrivateUser, path string, passphrase string) error {
+	privateKey, err := x509.MarshalPKCS8PrivateKey(user.privateKey)
 	if err != nil {
 		return err
 	}
-
-	data, err := json.Marshal(privateUserFile{Id: user.Id, Address: user.Address, PrivateKey: x509.MarshalPKCS1PrivateKey(user.privateKey)})
+	userFile := privateUserFile{Id: user.Id, Address: user.Address, Predecessor: user.Predecessor}
+	if passphrase == "" {
+		userFile.PrivateKey = privateKey
+	} else {
+		userFile.EncryptedKey, err = encryptKey(privateKey, user.Id, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(userFile)
 	if err != nil {
 		return err
 	}
-	_, err = fi.Write(data)
+
+	return fileutil.WriteAtomic(path, data)
+}
+
+func readUserFile(path string) (privateUserFile, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return privateUserFile{}, err
 	}
+	var userFile privateUserFile
+	err = json.Unmarshal(data, &userFile)
+	return userFile, err
+}
 
-	err = fi.Close()
+// Tells whether the private key in the user file is encrypted
+func UserEncrypted(path string) (bool, error) {
+	userFile, err := readUserFile(path)
 	if err != nil {
-		log.Printf("Error closing output file: %v", err)
+		return false, err
 	}
-	return nil
+	return userFile.EncryptedKey != nil, nil
 }
 
-func ReadUser(path string) (PrivateUser, error) {
-	data, err := os.ReadFile(path)
+// Reads the user written by WriteUser
+// A file with an unencrypted key is rewritten with the key encrypted if a passphrase is given
+// Files of older versions readable by others are made readable only by their owner
+func ReadUser(path string, passphrase string) (PrivateUser, error) {
+	userFile, err := readUserFile(path)
 	if err != nil {
 		return PrivateUser{}, err
 	}
-	var userFile privateUserFile
-	err = json.Unmarshal(data, &userFile)
+	fi, err := os.Stat(path)
 	if err != nil {
 		return PrivateUser{}, err
 	}
+	if fi.Mode().Perm()&0077 != 0 {
+		err = os.Chmod(path, 0600)
+		if err != nil {
+			return PrivateUser{}, err
+		}
+		log.Printf("%s is now readable only by its owner", path)
+	}
 
-	key, err := x509.ParsePKCS1PrivateKey(userFile.PrivateKey)
+	privateKey := userFile.PrivateKey
+	if userFile.EncryptedKey != nil {
+		privateKey, err = decryptKey(userFile.EncryptedKey, userFile.Id, passphrase)
+		if err != nil {
+			return PrivateUser{}, err
+		}
+	}
+	key, err := x509.ParsePKCS8PrivateKey(privateKey)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(privateKey)
+	}
 	if err != nil {
 		return PrivateUser{}, err
 	}
-
-	return PrivateUser{Id: userFile.Id, Address: userFile.Address, privateKey: key}, nil
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return PrivateUser{}, errKeyType
+	}
+	user := PrivateUser{Id: userFile.Id, Address: userFile.Address, Predecessor: userFile.Predecessor, privateKey: signer}
+
+	if userFile.EncryptedKey == nil && passphrase != "" {
+		err = WriteUser(user, path, passphrase)
+		if err != nil {
+			return PrivateUser{}, err
+		}
+		log.Printf("Private key in %s is now encrypted", path)
+	}
+	return user, nil
 }
 
-func GenUser(address string) (PrivateUser, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, userKeySize)
+// Generates a user with a key of the given type (KeyEd25519 or KeyRsa) and an ID that carries at least work bits of proof of work
+func GenUser(address string, keyType string, work int) (PrivateUser, error) {
+	privateKey, err := generateKey(keyType)
 	if err != nil {
 		return PrivateUser{}, err
 	}
 
-	pubString := base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&privateKey.PublicKey))
+	pubString, err := encodePublicKey(privateKey.Public())
+	if err != nil {
+		return PrivateUser{}, err
+	}
 
 	unsignedId := fmt.Sprintf("%s@%s", address, pubString)
 
@@ -92,15 +156,48 @@ func GenUser(address string) (PrivateUser, error) {
 	}
 
 	fullId := fmt.Sprintf("%s#%s", unsignedId, base64.StdEncoding.EncodeToString(signature))
+	if work > 0 {
+		fullId = proveWork(fullId, work)
+	}
 
 	return PrivateUser{Id: fullId, Address: address, privateKey: privateKey}, nil
 }
 
 var (
-	userIdPattern        = regexp.MustCompile(`(\S+)@(\S+)#(\S+)`)
+	// The signed ID may be followed by a nonce which proves work spent on the ID
+	userIdPattern        = regexp.MustCompile(`^(\S+)@(\S+)#([^\s$]+)(?:\$([0-9]+))?$`)
 	errUserParseIdFormat = errors.New("Bad user id format")
+	errUserWork          = errors.New("Not enough proof of work in user id")
 )
 
+// Sets the proof of work (in leading zero bits) that IDs must carry to be accepted by ParseUser
+func SetMinWork(work int) {
+	minWork = work
+}
+
+// Number of leading zero bits in the hash of the signed ID followed by the nonce
+func idWork(signedId string, nonce string) int {
+	hash := sha256.Sum256([]byte(signedId + "$" + nonce))
+	work := 0
+	for _, b := range hash {
+		work += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return work
+}
+
+// Appends to the signed ID the first nonce that gives at least work bits of proof of work
+func proveWork(signedId string, work int) string {
+	for nonce := uint64(0); ; nonce++ {
+		nonceString := strconv.FormatUint(nonce, 10)
+		if idWork(signedId, nonceString) >= work {
+			return signedId + "$" + nonceString
+		}
+	}
+}
+
 func ParseUser(id string) (PublicUser, error) {
 	matched := userIdPattern.FindStringSubmatch(id)
 	if matched == nil {
@@ -109,13 +206,17 @@ func ParseUser(id string) (PublicUser, error) {
 	address := matched[1]
 	pubString := matched[2]
 	signatureString := matched[3]
+	nonce := matched[4]
 
-	pubMarsh, err := base64.StdEncoding.DecodeString(pubString)
-	if err != nil {
-		return PublicUser{}, err
+	work := 0
+	if nonce != "" {
+		work = idWork(fmt.Sprintf("%s@%s#%s", address, pubString, signatureString), nonce)
+	}
+	if work < minWork { // checked first as it is much cheaper than the signature
+		return PublicUser{}, errUserWork
 	}
 
-	publicKey, err := x509.ParsePKCS1PublicKey(pubMarsh)
+	publicKey, err := decodePublicKey(pubString)
 	if err != nil {
 		return PublicUser{}, err
 	}
@@ -131,5 +232,5 @@ func ParseUser(id string) (PublicUser, error) {
 		return PublicUser{}, err
 	}
 
-	return PublicUser{Id: id, Address: address, publicKey: publicKey}, nil
+	return PublicUser{Id: id, Address: address, Work: work, publicKey: publicKey}, nil
 }
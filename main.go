@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rybbba/dist-pinger/client"
+	pb "github.com/rybbba/dist-pinger/grpc"
 	"github.com/rybbba/dist-pinger/identity"
 	"github.com/rybbba/dist-pinger/reputation"
 	"github.com/rybbba/dist-pinger/server"
@@ -16,15 +23,64 @@ import (
 var (
 	address  = flag.String("address", "", "The address (host:port) on which this node will be available for external users")
 	userFile = flag.String("userfile", "user.json", "Path to file with user data")
-	//nodeFile = flag.String("file", "nodes.json", "Path to file with nodes information")
+	nodeFile = flag.String("nodefile", "nodes.json", "Path to file with nodes information")
+
+	keyType     = flag.String("keytype", identity.KeyEd25519, "Key type of a newly generated user: ed25519 or rsa (3072 bits)")
+	allowLegacy = flag.Bool("allowlegacyids", false, "Accept legacy IDs of other nodes with 512-bit RSA keys, which can be forged")
+	idWork      = flag.Int("idwork", 20, "Bits of proof of work put into the ID of a newly generated user, nodes may refuse IDs with too little work")
+	minIdWork   = flag.Int("minidwork", 0, "Bits of proof of work that IDs of other nodes need for this node to track them and answer their requests")
+	rotate      = flag.Bool("rotate", false, "Replace the key of the user with a new one of -keytype and exit, the old key signs the new ID over so that other nodes move its ratings to it (only nodes that accept the old ID, so legacy IDs move only on nodes with -allowlegacyids)")
+
+	flushInterval = flag.Duration("flush", time.Minute, "How often nodes information is saved to the node file")
 
 	referer = flag.String("ref", "", "Node address to copy initializing ratings from")
 
+	allowedNets = flag.String("allownets", "", "Comma-separated list of networks (CIDR) that other users may check through this node even though they are private or local")
+
 	port = flag.Int("port", 5051, "The server port")
+
+	halfLife = flag.Duration("halflife", 30*24*time.Hour, "Time in which ratings of nodes lose half of their weight (0 disables decay)")
+	scoring  = flag.String("scoring", "threshold", "Model that decides which nodes are trusted: threshold (more good ratings than bad ones by a margin) or beta (lower confidence bound of the share of good ratings)")
+
+	trustMode     = flag.String("trust", "local", "How probes are ranked: local (by our own ratings, in random order) or eigentrust (by global trust computed from local trust of credible and reputable nodes and anchored on the nodes given as arguments)")
+	trustInterval = flag.Duration("trustinterval", 5*time.Minute, "How often global trust is recomputed in eigentrust mode")
+
+	weighted      = flag.Bool("weighted", false, "Weigh votes of probes by their reputation and the credibility of their recommenders, quarantined probes vote as well")
+	minConfidence = flag.Float64("minconfidence", 0, "Minimal winning margin of a vote (from 0 to 1) required to declare the status of a resource")
+
+	quorum = flag.Int("quorum", 0, "Number of valid answers from reputable probes to collect for every check, failed probes are replaced while there are candidates (0 disables replacement)")
 )
 
 func initUser() identity.PrivateUser {
-	readUser, err := identity.ReadUser(*userFile)
+	passphrase := ""
+	if *userFile != "" {
+		encrypted, err := identity.UserEncrypted(*userFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalf("cannot read user file: %v", err)
+		}
+		passphrase = readPassphrase(!encrypted) // a new or unencrypted key is about to be encrypted with it
+		if passphrase == "" && !encrypted {
+			log.Printf("Warning: private key in %s is not encrypted, set %s or enter a passphrase to encrypt it", *userFile, passphraseEnv)
+		}
+		if passphrase == "" && encrypted {
+			log.Fatalf("private key in %s is encrypted, set %s or enter its passphrase", *userFile, passphraseEnv)
+		}
+	}
+
+	readUser, err := identity.ReadUser(*userFile, passphrase)
+	if err == nil && *rotate {
+		log.Printf("Rotating the key of user from %s to a new %s key with %d bits of proof of work.", *userFile, *keyType, *idWork)
+		newUser, err := identity.RotateUser(readUser, *keyType, *idWork)
+		if err != nil {
+			log.Fatalf("cannot rotate user keys: %v", err)
+		}
+		err = identity.WriteUser(newUser, *userFile, passphrase)
+		if err != nil {
+			log.Fatalf("cannot write to user file: %v", err)
+		}
+		log.Printf("Rotated user configuration saved to %s, start the node without -rotate to use it.", *userFile)
+		os.Exit(0) // a flag left in a start script must not rotate the key on every start
+	}
 	if err == nil { // no errors
 		log.Printf("User configuration read from %s", *userFile)
 		return readUser
@@ -32,9 +88,12 @@ func initUser() identity.PrivateUser {
 	if !os.IsNotExist(err) {
 		log.Fatalf("cannot read user file: %v", err)
 	}
+	if *rotate {
+		log.Fatalf("cannot rotate user keys: there is no user in %s", *userFile)
+	}
 
-	log.Printf("Generating new user.")
-	genUser, err := identity.GenUser(*address)
+	log.Printf("Generating new %s user with %d bits of proof of work.", *keyType, *idWork)
+	genUser, err := identity.GenUser(*address, *keyType, *idWork)
 	if err != nil {
 		log.Fatalf("cannot initialize user keys: %v", err)
 	}
@@ -44,7 +103,7 @@ func initUser() identity.PrivateUser {
 		return genUser
 	}
 
-	err = identity.WriteUser(genUser, *userFile)
+	err = identity.WriteUser(genUser, *userFile, passphrase)
 	if err != nil {
 		log.Fatalf("cannot write to user file: %v", err)
 	}
@@ -60,12 +119,17 @@ func main() {
 	if *address == "" {
 		log.Fatalf("No address specified")
 	}
+	identity.SetMinWork(*minIdWork)
+	identity.SetAllowLegacyKeys(*allowLegacy)
 
 	selfUser := initUser()
 	// TODO: add fool-proof user validation
 
 	id := selfUser.Id
 	log.Printf("Your ID: %s", id)
+	if _, err := identity.ParseUser(id); err != nil {
+		log.Printf("Warning: nodes with the same settings will refuse your ID (%v), remove %s to generate a new one", err, *userFile)
+	}
 
 	nodeUsers := make([]identity.PublicUser, 0, len(ids))
 	for _, id := range ids {
@@ -76,9 +140,52 @@ func main() {
 		nodeUsers = append(nodeUsers, nodeUser)
 	}
 
-	reputationManager := reputation.ReputationManager{}
+	reputationManager := reputation.ReputationManager{HalfLife: *halfLife}
+	switch *scoring {
+	case "threshold":
+		reputationManager.Policy = reputation.ModelPolicy{Model: reputation.DefaultThresholdModel}
+	case "beta":
+		reputationManager.Policy = reputation.ModelPolicy{Model: reputation.DefaultBetaModel}
+	default:
+		log.Fatalf("unknown scoring model: %s", *scoring)
+	}
+	var eigenTrust *reputation.EigenTrust
+	switch *trustMode {
+	case "local":
+	case "eigentrust":
+		if len(nodeUsers) == 0 { // global trust is anchored on them, without any it stays empty
+			log.Fatalf("eigentrust mode needs IDs of pre-trusted nodes as arguments")
+		}
+		preTrusted := make([]string, 0, len(nodeUsers))
+		for _, user := range nodeUsers {
+			preTrusted = append(preTrusted, user.Id)
+		}
+		eigenTrust = &reputation.EigenTrust{PreTrusted: preTrusted}
+		reputationManager.Selector = eigenTrust
+	default:
+		log.Fatalf("unknown trust mode: %s", *trustMode)
+	}
 	reputationManager.InitNodes(nodeUsers)
-	if *referer != "" {
+	loaded := false
+	if *nodeFile != "" {
+		err := reputationManager.LoadNodes(*nodeFile)
+		if err == nil {
+			log.Printf("Nodes information read from %s", *nodeFile)
+			loaded = true
+		} else if !os.IsNotExist(err) {
+			log.Fatalf("cannot read node file: %v", err)
+		}
+	}
+	if selfUser.Predecessor != nil {
+		// our own ratings of other nodes stay, peers learn of the new ID from our requests
+		err := reputationManager.SetPredecessor(*selfUser.Predecessor)
+		if err != nil {
+			log.Printf("Warning: nodes will refuse the succession of your previous ID: %v", err)
+		}
+	}
+	if *referer != "" && loaded {
+		log.Printf("Using saved nodes information instead of copying reputations.")
+	} else if *referer != "" {
 		refUser, err := identity.ParseUser(*referer)
 		if err != nil {
 			log.Fatalf("error while copying reputations: %v", err)
@@ -89,31 +196,112 @@ func main() {
 		}
 	}
 
+	allowedNetworks := make([]netip.Prefix, 0)
+	for _, network := range strings.Split(*allowedNets, ",") {
+		if network == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			log.Fatalf("bad allowed network: %v", err)
+		}
+		allowedNetworks = append(allowedNetworks, prefix)
+	}
+
 	pingerServer := server.PingerServer{RepManager: &reputationManager}
 	pingerServer.SetUser(selfUser)
+	pingerServer.SetAllowedNetworks(allowedNetworks)
 	go pingerServer.Serve(*port)
 
-	pingerClient := client.PingerClient{RepManager: &reputationManager}
-	pingerClient.SetUser(selfUser)
-	for {
-		var host string
-		n, err := fmt.Scanln(&host)
+	saveNodes := func() {
+		if *nodeFile == "" {
+			return
+		}
+		err := reputationManager.SaveNodes(*nodeFile)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Bad input: %v", err)
-			continue
+			log.Printf("Cannot save nodes: %v", err)
 		}
-		if n != 1 {
+	}
+	if *nodeFile != "" {
+		go reputationManager.FlushNodes(*nodeFile, *flushInterval)
+	}
+	if eigenTrust != nil {
+		go reputationManager.UpdateTrust(selfUser, eigenTrust, *trustInterval)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		saveNodes()
+		os.Exit(0)
+	}()
+
+	pingerClient := client.PingerClient{RepManager: &reputationManager, Quorum: *quorum, Weighted: *weighted, MinConfidence: *minConfidence}
+	pingerClient.SetUser(selfUser)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
 			log.Printf("Bad input: no host provided")
 			continue
 		}
-		if host == "r" { // debug output
+		if args[0] == "r" { // debug output
 			fmt.Println(reputationManager.PrintSimpleRep())
 			continue
 		}
 
-		pingerClient.GetStatus(host)
+		check, err := client.ParseCheck(args)
+		if err != nil {
+			log.Printf("Bad input: %v", err)
+			continue
+		}
+		result, err := pingerClient.GetStatus(context.Background(), check)
+		if err != nil {
+			log.Printf("Check failed: %v", err)
+			continue
+		}
+		printResult(check, result)
+	}
+	saveNodes()
+}
+
+func printResult(check *pb.CheckHostRequest, result *client.CheckResult) {
+	reputableAnswers := make([]string, 0) // only print results by reputable probes
+	for _, probe := range result.Probes {
+		answer := probe.Answer
+		if tls := probe.Response.GetTls(); tls != nil {
+			answer += fmt.Sprintf(", certificate expires in %d days", tls.GetDaysToExpiry())
+		}
+		if probe.Reputable {
+			log.Printf("Probe %s answered in %v: %s", probe.Address, probe.Latency.Round(time.Millisecond), answer)
+			reputableAnswers = append(reputableAnswers, probe.Answer)
+		} else {
+			log.Printf("Quarantined probe %s answered in %v: %s", probe.Address, probe.Latency.Round(time.Millisecond), answer)
+		}
+		if probe.Err != nil {
+			log.Printf("Probe %s failed: %v", probe.Address, probe.Err)
+		}
+		if probe.Status == pb.CheckStatus_POLICY_REFUSED {
+			log.Printf("Probe %s refused to check the target", probe.Address)
+		}
+	}
+
+	log.Printf("Check result for %s: %q", result.Target, reputableAnswers)
+	log.Printf("Aggregated results: %v", result.Votes)
+	if check.GetType() == pb.CheckType_DNS && len(result.Votes) > 1 {
+		log.Printf("Reputable probes got different DNS answers, the name may be split-horizon or poisoned")
+	}
+	if result.Known() {
+		log.Printf("Resource status: %s (confidence %.2f)", result.Verdict, result.Confidence)
+	} else if len(result.Votes) > 0 {
+		log.Printf("Resource status: undecided, confidence %.2f is below %.2f", result.Confidence, *minConfidence)
+	} else {
+		log.Printf("Resource status: unknown, no reputable probe has checked the target")
+	}
+	if *quorum > 0 {
+		log.Printf("Quorum: %d of %d reputable probes gave valid answers", result.ValidAnswers(), *quorum)
+	}
+	if summary := result.TimingsSummary(); summary != "" {
+		log.Printf("Timings across reputable probes (min/median/p95): %s", summary)
 	}
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/term"
+)
+
+var (
+	passphraseEnv = "DIST_PINGER_PASSPHRASE"
+)
+
+// Takes the passphrase of the user file from the environment or asks for it if the input is a terminal
+// Without either the key is kept unencrypted
+// A passphrase that is going to encrypt the key is asked twice when confirm is set, as a typo would lock the key away
+func readPassphrase(confirm bool) string {
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return passphrase
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) { // piped input holds commands, not the passphrase
+		return ""
+	}
+
+	for {
+		passphrase := promptPassphrase(fmt.Sprintf("Passphrase for %s (empty to keep the key unencrypted): ", *userFile))
+		if !confirm || passphrase == "" {
+			return passphrase
+		}
+		if promptPassphrase("Repeat the passphrase: ") == passphrase {
+			return passphrase
+		}
+		fmt.Fprintln(os.Stderr, "Passphrases do not match.")
+	}
+}
+
+func promptPassphrase(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd())) // reads byte by byte, the commands after the passphrase stay in the input
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatalf("cannot read passphrase: %v", err)
+	}
+	return string(passphrase)
+}
@@ -0,0 +1,248 @@
+package reputation
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+	"github.com/rybbba/dist-pinger/identity"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var (
+	// Share of trust that returns to pre-trusted nodes in every iteration, keeps collectives of malicious nodes from keeping trust to themselves
+	eigenTrustAlpha      = 0.15
+	eigenTrustIterations = 100
+	eigenTrustEpsilon    = 1e-9
+
+	// Nodes are asked for their local trust in parallel and must answer within this time
+	trustTimeout = 30 * time.Second
+	// At most this many trust requests are in flight at once
+	trustQueries = 16
+	// Trust vectors with more entries are refused
+	maxTrustEntries = 10000
+
+	errTrustEntries = errors.New("Too many entries in trust vector")
+)
+
+// Global trust of nodes computed EigenTrust-style from local trust vectors of the nodes we know
+// Trust is anchored on the pre-trusted nodes, the reference group we were started with
+// It is also a ProbeSelector that orders reputable probes by their global trust
+type EigenTrust struct {
+	PreTrusted []string // IDs of pre-trusted nodes
+
+	global map[string]float64
+	mutex  sync.RWMutex
+}
+
+func (e *EigenTrust) Trust(id string) float64 {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.global[id]
+}
+
+func (e *EigenTrust) Select(candidates []Probe) ProbePool {
+	pool := DefaultSelector.Select(candidates) // probes with equal trust stay in random order
+	e.mutex.RLock()
+	sort.SliceStable(pool.Reputable, func(i, j int) bool {
+		return e.global[pool.Reputable[i].User.Id] > e.global[pool.Reputable[j].User.Id]
+	})
+	e.mutex.RUnlock()
+	return pool
+}
+
+// Recomputes global trust from local trust vectors of nodes, vectors are keyed by the ID of the node that gave them
+func (e *EigenTrust) compute(vectors map[string]map[string]float64) {
+	preTrusted := make(map[string]float64)
+	for _, id := range e.PreTrusted {
+		preTrusted[id] = 1 / float64(len(e.PreTrusted))
+	}
+
+	// every row is normalized again, the trust a node gives to itself does not count
+	rows := make(map[string]map[string]float64)
+	for from, vector := range vectors {
+		total := 0.0
+		for to, value := range vector {
+			if to != from && value > 0 {
+				total += value
+			}
+		}
+		if total == 0 || math.IsInf(total, 0) { // nodes that trust nobody pass their trust to pre-trusted nodes
+			continue
+		}
+		row := make(map[string]float64)
+		for to, value := range vector {
+			if to != from && value > 0 {
+				row[to] = value / total
+			}
+		}
+		rows[from] = row
+	}
+
+	trust := preTrusted
+	for i := 0; i < eigenTrustIterations; i++ {
+		next := make(map[string]float64)
+		for id, value := range preTrusted {
+			next[id] = eigenTrustAlpha * value
+		}
+		for from, value := range trust {
+			row, ok := rows[from]
+			if !ok {
+				row = preTrusted
+			}
+			for to, share := range row {
+				next[to] += (1 - eigenTrustAlpha) * value * share
+			}
+		}
+
+		diff := 0.0
+		for id := range next {
+			diff += math.Abs(next[id] - trust[id])
+		}
+		for id := range trust {
+			if _, ok := next[id]; !ok {
+				diff += trust[id]
+			}
+		}
+		trust = next
+		if diff < eigenTrustEpsilon {
+			break
+		}
+	}
+
+	e.mutex.Lock()
+	e.global = trust
+	e.mutex.Unlock()
+}
+
+// Local trust vector of this node: our decayed net reputation of every node, normalized to add up to 1
+func (rm *ReputationManager) LocalTrust() map[string]float64 {
+	vector := make(map[string]float64)
+	total := 0.0
+	for _, node := range rm.Store.All() {
+		node = rm.current(node)
+		if value := node.reputationGood - node.reputationBad; value > 0 {
+			vector[node.user.Id] = value
+			total += value
+		}
+	}
+	for id := range vector {
+		vector[id] /= total
+	}
+	return vector
+}
+
+func (rm *ReputationManager) queryTrust(ctx context.Context, sender identity.PrivateUser, target identity.PublicUser) (map[string]float64, error) {
+	conn, err := grpc.Dial(target.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := pb.NewReputationClient(conn)
+
+	now := time.Now()
+	message := pb.GetTrustRequest{
+		Sender:    sender.Id,
+		IssuedAt:  now.UnixMilli(),
+		ExpiresAt: now.Add(identity.RequestLifetime).UnixMilli(),
+		Nonce:     identity.NewNonce(),
+		Recipient: target.Id,
+	}
+	signature, err := identity.SignProto(sender, &message)
+	if err != nil {
+		log.Fatalf("cannot sign message: %v", err)
+	}
+	message.Signature = signature
+
+	r, err := c.GetTrust(ctx, &message)
+	if err != nil {
+		return nil, err
+	}
+	signature = r.Signature
+	r.Signature = nil
+	err = identity.VerifyProto(target, r, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.GetTrusts()) > maxTrustEntries {
+		return nil, errTrustEntries
+	}
+	vector := make(map[string]float64)
+	for _, trustMsg := range r.GetTrusts() {
+		value := trustMsg.GetValue()
+		if math.IsNaN(value) || math.IsInf(value, 0) || value < 0 { // a single such value would spoil the trust of every node
+			continue
+		}
+		vector[trustMsg.GetId()] += value
+	}
+	return vector, nil
+}
+
+// Nodes whose local trust is worth asking for: pre-trusted, credible and reputable ones
+// Any node that sends us a request becomes known, so asking all known nodes would have no bound
+func (rm *ReputationManager) trustSources(trust *EigenTrust) []Node {
+	preTrusted := make(map[string]bool)
+	for _, id := range trust.PreTrusted {
+		preTrusted[id] = true
+	}
+	nodes := make([]Node, 0)
+	for _, node := range rm.Store.All() {
+		current := rm.current(node)
+		if preTrusted[node.user.Id] || rm.policy().IsCredible(current) || rm.policy().IsReputable(current) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Asks pre-trusted, credible and reputable nodes for their local trust vectors and recomputes global trust
+// Nodes that do not answer or are not asked are treated as trusting only the pre-trusted nodes
+func (rm *ReputationManager) RefreshTrust(sender identity.PrivateUser, trust *EigenTrust) {
+	ctx, cancel := context.WithTimeout(context.Background(), trustTimeout)
+	defer cancel()
+
+	type answer struct {
+		id     string
+		vector map[string]float64
+	}
+	nodes := rm.trustSources(trust)
+	arrived := make(chan answer)
+	slots := make(chan struct{}, trustQueries)
+	for _, node := range nodes {
+		go func(user identity.PublicUser) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			vector, err := rm.queryTrust(ctx, sender, user)
+			if err != nil {
+				log.Printf("error during trust request to %s: %v", user.Address, err)
+			}
+			arrived <- answer{id: user.Id, vector: vector}
+		}(node.user)
+	}
+
+	vectors := map[string]map[string]float64{sender.Id: rm.LocalTrust()}
+	for range nodes {
+		a := <-arrived
+		if a.vector != nil && a.id != sender.Id {
+			vectors[a.id] = a.vector
+		}
+	}
+	trust.compute(vectors)
+}
+
+// Recomputes global trust every interval, never returns
+func (rm *ReputationManager) UpdateTrust(sender identity.PrivateUser, trust *EigenTrust, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		rm.RefreshTrust(sender, trust)
+	}
+}
@@ -1,18 +1,34 @@
 package reputation
 
-import "github.com/rybbba/dist-pinger/identity"
+import (
+	"math"
+	"time"
 
-var (
-	reputationThreshold  = 2
-	credibilityThreshold = 2
+	"github.com/rybbba/dist-pinger/identity"
 )
 
+// Ratings are sums of evidence that decay over time, they were last brought up to date at updated
 type Node struct {
 	user            identity.PublicUser
-	reputationGood  int
-	reputationBad   int
-	credibilityGood int
-	credibilityBad  int
+	reputationGood  float64
+	reputationBad   float64
+	credibilityGood float64
+	credibilityBad  float64
+	updated         time.Time
+}
+
+func (node Node) User() identity.PublicUser {
+	return node.user
+}
+
+// Good and bad ratings of the node as a probe
+func (node Node) Reputation() (float64, float64) {
+	return node.reputationGood, node.reputationBad
+}
+
+// Good and bad ratings of the node as a recommender
+func (node Node) Credibility() (float64, float64) {
+	return node.credibilityGood, node.credibilityBad
 }
 
 func nodeInit(user identity.PublicUser) Node {
@@ -23,11 +39,35 @@ func nodeInitRef(user identity.PublicUser) Node {
 	node := nodeInit(user)
 	node.reputationGood = 5
 	node.credibilityGood = 5
+	node.updated = time.Now()
+	return node
+}
+
+// Returns the node with its ratings decayed to the moment now, every piece of evidence loses half of its weight each halfLife
+// Nothing decays if halfLife is not positive, ratings of a node that was never updated are taken as current
+func decay(node Node, now time.Time, halfLife time.Duration) Node {
+	if halfLife > 0 && !node.updated.IsZero() && now.After(node.updated) {
+		factor := math.Exp2(-float64(now.Sub(node.updated)) / float64(halfLife))
+		node.reputationGood *= factor
+		node.reputationBad *= factor
+		node.credibilityGood *= factor
+		node.credibilityBad *= factor
+	}
+	node.updated = now
+	return node
+}
+
+// Adds ratings of the other node to the node, both must be decayed to the same moment
+func mergeRatings(node Node, other Node) Node {
+	node.reputationGood += other.reputationGood
+	node.reputationBad += other.reputationBad
+	node.credibilityGood += other.credibilityGood
+	node.credibilityBad += other.credibilityBad
 	return node
 }
 
-func IsReputable(node Node) bool {
-	return node.reputationGood-node.reputationBad >= reputationThreshold
+func IsReputable(model ScoringModel, node Node) bool {
+	return model.Trusted(node.reputationGood, node.reputationBad)
 }
 
 func RaiseReputation(node Node) Node {
@@ -40,8 +80,8 @@ func LowerReputation(node Node) Node {
 	return node
 }
 
-func IsCredible(node Node) bool {
-	return node.credibilityGood-node.credibilityBad >= credibilityThreshold
+func IsCredible(model ScoringModel, node Node) bool {
+	return model.Trusted(node.credibilityGood, node.credibilityBad)
 }
 
 func RaiseCredibility(node Node) Node {
@@ -54,6 +94,19 @@ func LowerCredibility(node Node) Node {
 	return node
 }
 
+// Vote weight of a probe: our reputation score of it plus the mean credibility score of the recommenders that vouched for it
+func probeWeight(model ScoringModel, node Node, vouchers []Node) float64 {
+	weight := model.Score(node.reputationGood, node.reputationBad)
+	if len(vouchers) > 0 {
+		credibility := 0.0
+		for _, voucher := range vouchers {
+			credibility += model.Score(voucher.credibilityGood, voucher.credibilityBad)
+		}
+		weight += credibility / float64(len(vouchers))
+	}
+	return weight
+}
+
 type probeRecommender struct {
 	user             identity.PublicUser
 	quarantinedProbe bool
@@ -62,6 +115,13 @@ type probeRecommender struct {
 type Probe struct {
 	User      identity.PublicUser
 	Reputable bool
+	Weight    float64 // how much the probe's answer counts in weighted voting
 
 	recommenders []probeRecommender
 }
+
+// Probes recommended to us in random order
+type ProbePool struct {
+	Reputable   []Probe // all reputable probes
+	Quarantined []Probe // a random pick of quarantined probes
+}
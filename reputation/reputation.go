@@ -20,59 +20,78 @@ var (
 
 	pickProbesQuarantine       = 2
 	pickRecommendersQuarantine = 1
+
+	// All recommenders are queried in parallel and must answer within this time
+	recommendersTimeout = 30 * time.Second
 )
 
 type ReputationManager struct {
-	Nodes map[string]Node
-
-	mutex sync.RWMutex
+	// Store keeps ratings of known nodes, InitNodes creates a MemoryStore if it is nil
+	Store NodeStore
+	// Policy decides which nodes are trusted, DefaultPolicy is used if it is nil
+	Policy TrustPolicy
+	// Selector picks probes for checks, DefaultSelector is used if it is nil
+	Selector ProbeSelector
+	// Every rating loses half of its weight each HalfLife, ratings never decay if it is not positive
+	HalfLife time.Duration
+
+	successions map[string]identity.Succession // by old ID
+	predecessor *identity.Succession           // hands our previous ID over to our current one
+	mutex       sync.Mutex                     // guards successions and predecessor
 }
 
 // debug output function
 func (rm *ReputationManager) PrintSimpleRep() string {
 	res := ""
-	rm.mutex.Lock()
 	first := true
-	for _, node := range rm.Nodes {
+	for _, node := range rm.Store.All() {
 		if !first {
 			res += ","
 		}
 		first = false
-		res += fmt.Sprintf("%s: %d %d", node.user.Address, node.reputationGood-node.reputationBad, node.credibilityGood-node.credibilityBad)
+		node = rm.current(node)
+		res += fmt.Sprintf("%s: %.1f %.1f", node.user.Address, node.reputationGood-node.reputationBad, node.credibilityGood-node.credibilityBad)
 	}
-	rm.mutex.Unlock()
 	return res
 }
 
-func (rm *ReputationManager) InitNodes(users []identity.PublicUser) {
-	rm.Nodes = make(map[string]Node)
-	for _, user := range users {
-		rm.Nodes[user.Id] = nodeInitRef(user)
+func (rm *ReputationManager) policy() TrustPolicy {
+	if rm.Policy == nil {
+		return DefaultPolicy
+	}
+	return rm.Policy
+}
+
+func (rm *ReputationManager) selector() ProbeSelector {
+	if rm.Selector == nil {
+		return DefaultSelector
 	}
+	return rm.Selector
 }
 
-func pickN(total int, n int) []int {
-	return rand.Perm(total)[:n]
+// Returns the node with its ratings decayed to the current moment
+func (rm *ReputationManager) current(node Node) Node {
+	return decay(node, time.Now(), rm.HalfLife)
 }
 
-// TODO: make sure that following functions will work as intended
-// with an address that is not in the manager's nodes keys
-
-// TODO: I must refactor this
-func (rm *ReputationManager) GiveProbes(sender identity.PublicUser, withCredibility bool) *pb.GetReputationsResponse {
-	message := &pb.GetReputationsResponse{Probes: make([]*pb.Probe, 0)}
-	for _, node := range rm.Nodes {
-		probeMsg := pb.Probe{Id: node.user.Id, ReputationGood: int32(node.reputationGood), ReputationBad: int32(node.reputationBad)}
-		if withCredibility {
-			probeMsg.CredibilityGood = int32(node.credibilityGood)
-			probeMsg.CredibilityBad = int32(node.credibilityBad)
-		}
-		message.Probes = append(message.Probes, &probeMsg)
+func (rm *ReputationManager) InitNodes(users []identity.PublicUser) {
+	if rm.Store == nil {
+		rm.Store = NewMemoryStore()
+	}
+	for _, user := range users {
+		rm.Store.Put(nodeInitRef(user))
 	}
-	if _, ok := rm.Nodes[sender.Id]; !ok {
-		rm.Nodes[sender.Id] = nodeInit(sender)
+}
+
+func (rm *ReputationManager) GiveNodes(sender identity.PublicUser) []Node {
+	nodes := rm.Store.All()
+	for i, node := range nodes {
+		nodes[i] = rm.current(node) // peers get the same decayed ratings that we use ourselves
 	}
-	return message
+	if !rm.succeeded(sender.Id) { // a node that still uses its old key does not bring the old ID back
+		rm.Store.Add(nodeInit(sender))
+	}
+	return nodes
 }
 
 func (rm *ReputationManager) CopyReputation(sender identity.PrivateUser, target identity.PublicUser) error {
@@ -86,7 +105,16 @@ func (rm *ReputationManager) CopyReputation(sender identity.PrivateUser, target
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	message := pb.GetReputationsRequest{Sender: sender.Id, NeedCredibilities: true}
+	now := time.Now()
+	message := pb.GetReputationsRequest{
+		Sender:            sender.Id,
+		NeedCredibilities: true,
+		IssuedAt:          now.UnixMilli(),
+		ExpiresAt:         now.Add(identity.RequestLifetime).UnixMilli(),
+		Nonce:             identity.NewNonce(),
+		Recipient:         target.Id,
+		Succession:        rm.predecessorMessage(),
+	}
 	signature, err := identity.SignProto(sender, &message)
 	if err != nil {
 		log.Fatalf("cannot sign message: %v", err)
@@ -105,7 +133,7 @@ func (rm *ReputationManager) CopyReputation(sender identity.PrivateUser, target
 	}
 
 	for _, probeMsg := range r.GetProbes() {
-		if probeMsg.Id == sender.Id {
+		if probeMsg.Id == sender.Id || rm.succeeded(probeMsg.Id) {
 			continue
 		}
 
@@ -114,170 +142,192 @@ func (rm *ReputationManager) CopyReputation(sender identity.PrivateUser, target
 			continue
 		}
 		node := nodeInit(nodeUser)
-		node.reputationGood, node.reputationBad = int(probeMsg.ReputationGood), int(probeMsg.ReputationBad)
-		node.credibilityGood, node.credibilityBad = int(probeMsg.CredibilityGood), int(probeMsg.CredibilityBad)
-		rm.mutex.Lock()
-		rm.Nodes[nodeUser.Id] = node
-		rm.mutex.Unlock()
+		node.reputationGood, node.reputationBad = float64(probeMsg.ReputationGood), float64(probeMsg.ReputationBad)
+		node.credibilityGood, node.credibilityBad = float64(probeMsg.CredibilityGood), float64(probeMsg.CredibilityBad)
+		node.updated = time.Now()
+		rm.Store.Put(node)
 	}
-	rm.Nodes[target.Id] = nodeInitRef(target)
-	// log.Printf("Copied reputations: %v", rm.Nodes)
+	rm.addSuccessions(r.GetSuccessions())
+	rm.Store.Put(nodeInitRef(target))
 	return nil
 }
 
-// Are we sure that we want reputation manager to pick nodes for us? Maybe this should be moved to the client?
-func (rm *ReputationManager) GetProbes(sender identity.PrivateUser, pickProbes int) []Probe {
-	rm.mutex.RLock()
-	recommenders := [][]Node{make([]Node, 0), make([]Node, 0)} // reliable and quarantined
+func (rm *ReputationManager) queryRecommender(ctx context.Context, sender identity.PrivateUser, recommender identity.PublicUser) ([]*pb.Probe, error) {
+	conn, err := grpc.Dial(recommender.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := pb.NewReputationClient(conn)
 
-	for _, node := range rm.Nodes {
-		if IsCredible(node) {
-			recommenders[0] = append(recommenders[0], node)
-		} else {
-			recommenders[1] = append(recommenders[1], node)
-		}
+	now := time.Now()
+	message := pb.GetReputationsRequest{
+		Sender:     sender.Id,
+		IssuedAt:   now.UnixMilli(),
+		ExpiresAt:  now.Add(identity.RequestLifetime).UnixMilli(),
+		Nonce:      identity.NewNonce(),
+		Recipient:  recommender.Id,
+		Succession: rm.predecessorMessage(),
+	}
+	signature, err := identity.SignProto(sender, &message)
+	if err != nil {
+		log.Fatalf("cannot sign message: %v", err)
 	}
-	rm.mutex.RUnlock()
+	message.Signature = signature
 
-	cntRec := []int{pickRecommenders, pickRecommendersQuarantine} // for reliable and quarantined random picks
+	r, err := c.GetReputations(ctx, &message)
+	if err != nil {
+		return nil, err
+	}
+	signature = r.Signature
+	r.Signature = nil
+	err = identity.VerifyProto(recommender, r, signature)
+	if err != nil {
+		return nil, err
+	}
+	rm.addSuccessions(r.GetSuccessions())
+	return r.GetProbes(), nil
+}
 
-	probesMap := make(map[string]Probe)
+// Adds probes recommended by the recommender to probesMap
+func (rm *ReputationManager) mergeProbes(probesMap map[string]Probe, sender identity.PrivateUser, recommender identity.PublicUser, credible bool, probeMsgs []*pb.Probe) {
+	for _, probeMsg := range probeMsgs {
+		if probeMsg.GetId() == sender.Id || rm.succeeded(probeMsg.GetId()) {
+			continue
+		}
+		probeUser, err := identity.ParseUser(probeMsg.Id)
+		if err != nil {
+			continue
+		}
+		rm.Store.Add(nodeInit(probeUser))
 
-	for recType := 0; recType < len(cntRec); recType++ {
-		indPerm := rand.Perm(len(recommenders[recType]))
-		for pos := 0; pos < cntRec[recType] && pos < len(recommenders[recType]); pos++ {
-			ind := indPerm[pos]
-			recommender := recommenders[recType][ind]
-			conn, err := grpc.Dial(recommender.user.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
-			if err != nil {
-				log.Printf("did not connect to %s: %v", recommender.user.Address, err)
-				// if the request to a credible recommender fails we want to find another one to not lose the voting process quality
-				if recType == 0 {
-					cntRec[recType] += 1
-				}
+		node := Node{user: probeUser, reputationGood: float64(probeMsg.GetReputationGood()), reputationBad: float64(probeMsg.ReputationBad)}
+		probe, ok := probesMap[node.user.Id]
+		if !ok {
+			probe.User = node.user
+			probe.recommenders = make([]probeRecommender, 0)
+		}
+		if rm.policy().IsReputable(node) { // reputable (for recommender) probe
+			if credible {
+				probe.Reputable = true // we trust recommender
 			}
-			defer conn.Close()
-			c := pb.NewReputationClient(conn)
+			probe.recommenders = append(probe.recommenders, probeRecommender{user: recommender, quarantinedProbe: false})
+		} else if credible { // quarantined (for recommender) probe
+			probe.recommenders = append(probe.recommenders, probeRecommender{user: recommender, quarantinedProbe: true})
+		} // we don't need quarantined probes from quarantined recommenders
+		probesMap[probe.User.Id] = probe
+	}
+}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
+// Asks recommenders for their probes and merges the answers
+func (rm *ReputationManager) collectProbes(sender identity.PrivateUser) map[string]Probe {
+	credible, quarantined := make([]Node, 0), make([]Node, 0)
+	for _, node := range rm.Store.All() {
+		if rm.policy().IsCredible(rm.current(node)) {
+			credible = append(credible, node)
+		} else {
+			quarantined = append(quarantined, node)
+		}
+	}
+	rand.Shuffle(len(credible), func(i, j int) { credible[i], credible[j] = credible[j], credible[i] })
+	rand.Shuffle(len(quarantined), func(i, j int) { quarantined[i], quarantined[j] = quarantined[j], quarantined[i] })
 
-			message := pb.GetReputationsRequest{Sender: sender.Id}
-			signature, err := identity.SignProto(sender, &message)
-			if err != nil {
-				log.Fatalf("cannot sign message: %v", err)
-			}
-			message.Signature = signature
-
-			r, err := c.GetReputations(ctx, &message)
-			if err != nil {
-				log.Printf("error during recommender request to %s: %v", recommender.user.Address, err)
-				// if the request to a credible recommender fails we want to find another one to not lose the voting process quality
-				if recType == 0 {
-					cntRec[recType] += 1
-				}
-			}
-			signature = r.Signature
-			r.Signature = nil
-			err = identity.VerifyProto(recommender.user, r, signature)
-			if err != nil {
-				log.Printf("error during recommender request to %s: %v", recommender.user.Address, err)
-				// if the request to a credible recommender fails we want to find another one to not lose the voting process quality
-				if recType == 0 {
-					cntRec[recType] += 1
-				}
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), recommendersTimeout)
+	defer cancel()
 
-			for _, probeMsg := range r.GetProbes() {
-				if probeMsg.GetId() == sender.Id {
-					continue
-				}
-				probeUser, err := identity.ParseUser(probeMsg.Id)
-				if err != nil {
-					continue
-				}
-				if _, ok := rm.Nodes[probeUser.Id]; !ok {
-					rm.Nodes[probeUser.Id] = nodeInit(probeUser)
-				}
+	type recommendation struct {
+		recommender identity.PublicUser
+		credible    bool
+		probes      []*pb.Probe
+		err         error
+	}
+	arrived := make(chan recommendation)
+	pending := 0
+	ask := func(recommender Node, credible bool) {
+		pending++
+		go func() {
+			probes, err := rm.queryRecommender(ctx, sender, recommender.user)
+			arrived <- recommendation{recommender: recommender.user, credible: credible, probes: probes, err: err}
+		}()
+	}
 
-				node := Node{user: probeUser, reputationGood: int(probeMsg.GetReputationGood()), reputationBad: int(probeMsg.ReputationBad)}
-				probe, ok := probesMap[node.user.Id]
-				if !ok {
-					probe.User = node.user
-					probe.recommenders = make([]probeRecommender, 0)
-				}
-				if IsReputable(node) { // reputable (for recommender) probe
-					if recType == 0 { // credible recommender
-						probe.Reputable = true // we trust recommender
-						probe.recommenders = append(probe.recommenders, probeRecommender{user: recommender.user, quarantinedProbe: false})
-					} else { // quarantined recommender
-						probe.recommenders = append(probe.recommenders, probeRecommender{user: recommender.user, quarantinedProbe: false})
-					}
-				} else { // quarantined (for recommender) probe
-					if recType == 0 { // credible recommender
-						probe.recommenders = append(probe.recommenders, probeRecommender{user: recommender.user, quarantinedProbe: true})
-					}
-					// we don't need quarantined probes from quarantined recommenders
-				}
-				probesMap[probe.User.Id] = probe
+	nextCredible := 0
+	for ; nextCredible < pickRecommenders && nextCredible < len(credible); nextCredible++ {
+		ask(credible[nextCredible], true)
+	}
+	for i := 0; i < pickRecommendersQuarantine && i < len(quarantined); i++ {
+		ask(quarantined[i], false)
+	}
+
+	probesMap := make(map[string]Probe)
+	for ; pending > 0; pending-- {
+		rec := <-arrived
+		if rec.err != nil {
+			log.Printf("error during recommender request to %s: %v", rec.recommender.Address, rec.err)
+			// if the request to a credible recommender fails we want to find another one to not lose the voting process quality
+			if rec.credible && nextCredible < len(credible) && ctx.Err() == nil {
+				ask(credible[nextCredible], true)
+				nextCredible++
 			}
+			continue
 		}
+		rm.mergeProbes(probesMap, sender, rec.recommender, rec.credible, rec.probes)
 	}
-	probes := make([]Probe, 0)
-	probesQuarantine := make([]Probe, 0)
+	return probesMap
+}
 
-	for _, probe := range probesMap {
-		if probe.Reputable {
-			probes = append(probes, probe)
-		} else {
-			probesQuarantine = append(probesQuarantine, probe)
+// Are we sure that we want reputation manager to pick nodes for us? Maybe this should be moved to the client?
+func (rm *ReputationManager) GetProbePool(sender identity.PrivateUser) ProbePool {
+	candidates := make([]Probe, 0)
+	for _, probe := range rm.collectProbes(sender) {
+		vouchers := make([]Node, 0, len(probe.recommenders))
+		for _, recommender := range probe.recommenders {
+			if !recommender.quarantinedProbe {
+				vouchers = append(vouchers, rm.knownNode(recommender.user))
+			}
 		}
+		probe.Weight = rm.policy().ProbeWeight(rm.knownNode(probe.User), vouchers)
+		candidates = append(candidates, probe)
 	}
+	return rm.selector().Select(candidates)
+}
 
-	cntProbes := pickProbes
-	if len(probes) < cntProbes {
-		cntProbes = len(probes)
-	}
-	cntProbesQ := pickProbesQuarantine
-	if len(probesQuarantine) < cntProbesQ {
-		cntProbesQ = len(probesQuarantine)
+// Returns the stored node with its ratings decayed to the current moment, a node without ratings if it is unknown
+func (rm *ReputationManager) knownNode(user identity.PublicUser) Node {
+	node, ok := rm.Store.Get(user.Id)
+	if !ok {
+		return nodeInit(user)
 	}
+	return rm.current(node)
+}
 
-	res := make([]Probe, 0, cntProbes+cntProbesQ)
-
-	for _, i := range pickN(len(probes), cntProbes) {
-		res = append(res, probes[i])
-	}
-	for _, i := range pickN(len(probesQuarantine), cntProbesQ) {
-		res = append(res, probesQuarantine[i])
+func (rm *ReputationManager) GetProbes(sender identity.PrivateUser, pickProbes int) []Probe {
+	pool := rm.GetProbePool(sender)
+	if len(pool.Reputable) > pickProbes {
+		pool.Reputable = pool.Reputable[:pickProbes]
 	}
-
-	return res
+	return append(pool.Reputable, pool.Quarantined...)
 }
 
 // Takes an array of probes returned by GetServers and an array of our satisfaction from corresponding probes' work
 // Negative satisfaction means that probe's answer was bad, positive that it was good and zero means that we don't want to rate it
-// All passed probes already have an entry in rm.Nodes
+// All passed probes already have an entry in rm.Store
 func (rm *ReputationManager) EvaluateVotes(probes []Probe, satisfaction []int) {
 	for i, probe := range probes {
 		if satisfaction[i] > 0 {
-			rm.mutex.Lock()
-			rm.Nodes[probe.User.Id] = RaiseReputation(rm.Nodes[probe.User.Id])
+			rm.Store.Update(probe.User.Id, func(node Node) Node { return RaiseReputation(rm.current(node)) })
 			for _, recommender := range probe.recommenders {
 				if !recommender.quarantinedProbe { // if a good probe was also reputable in recommender's point of view then it probably is credible
-					rm.Nodes[recommender.user.Id] = RaiseCredibility(rm.Nodes[recommender.user.Id])
+					rm.Store.Update(recommender.user.Id, func(node Node) Node { return RaiseCredibility(rm.current(node)) })
 				}
 			}
-			rm.mutex.Unlock()
 		} else if satisfaction[i] < 0 {
-			rm.mutex.Lock()
-			rm.Nodes[probe.User.Id] = LowerReputation(rm.Nodes[probe.User.Id])
+			rm.Store.Update(probe.User.Id, func(node Node) Node { return LowerReputation(rm.current(node)) })
 			for _, recommender := range probe.recommenders {
 				if !recommender.quarantinedProbe { // // if a bad probe was reputable in recommender's point of view then it probably is not credible
-					rm.Nodes[recommender.user.Id] = LowerCredibility(rm.Nodes[recommender.user.Id])
+					rm.Store.Update(recommender.user.Id, func(node Node) Node { return LowerCredibility(rm.current(node)) })
 				}
 			}
-			rm.mutex.Unlock()
 		}
 	}
 }
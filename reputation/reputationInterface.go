@@ -1,7 +1,6 @@
 package reputation
 
 import (
-	pb "github.com/rybbba/dist-pinger/grpc"
 	"github.com/rybbba/dist-pinger/identity"
 )
 
@@ -9,11 +8,46 @@ type ReputationManagerInterface interface {
 	InitNodes(users []identity.PublicUser)
 
 	GetProbes(sender identity.PrivateUser, pickProbes int) []Probe
+	GetProbePool(sender identity.PrivateUser) ProbePool
 
 	CopyReputation(sender identity.PrivateUser, target identity.PublicUser) error
 
 	EvaluateVotes(probes []Probe, satisfaction []int)
 
-	PrintSimpleRep() string                                                                 // Debug function
-	GiveProbes(sender identity.PublicUser, withCredibility bool) *pb.GetReputationsResponse // not very interface-like, should probably be refactored
+	PrintSimpleRep() string                      // Debug function
+	GiveNodes(sender identity.PublicUser) []Node // ratings we share with the sender, the sender becomes known to us
+	LocalTrust() map[string]float64              // normalized trust we give to other nodes
+
+	// Moves ratings of the old ID of a rotated key to the new ID once the succession is verified
+	AddSuccession(succession identity.Succession) error
+	Successions() []identity.Succession                  // verified successions we pass on to other nodes
+	SetPredecessor(succession identity.Succession) error // our own succession, sent with our requests
+}
+
+// Keeps ratings of known nodes, implementations must be safe for concurrent use
+type NodeStore interface {
+	Get(id string) (Node, bool)
+	// Adds the node unless a node with the same ID is already known
+	Add(node Node)
+	// Replaces the node with the same ID or adds it
+	Put(node Node)
+	// Replaces a known node with the result of update, unknown nodes are left alone
+	Update(id string, update func(Node) Node)
+	// Removes the node and returns it if it was known
+	Delete(id string) (Node, bool)
+	All() []Node
+}
+
+// Decides which nodes are trusted and how much their answers count
+// Nodes are passed with their ratings decayed to the current moment
+type TrustPolicy interface {
+	IsReputable(node Node) bool
+	IsCredible(node Node) bool
+	// Vote weight of a probe that was vouched for by the given recommenders
+	ProbeWeight(node Node, vouchers []Node) float64
+}
+
+// Picks probes for a check out of the probes recommended to us
+type ProbeSelector interface {
+	Select(candidates []Probe) ProbePool
 }
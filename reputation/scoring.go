@@ -0,0 +1,75 @@
+package reputation
+
+import "math"
+
+var (
+	DefaultThresholdModel = ThresholdModel{Threshold: 2}
+	DefaultPolicy         = ModelPolicy{Model: DefaultThresholdModel}
+	// Nodes need four good ratings without bad ones to be trusted, reference nodes start with five
+	DefaultBetaModel = BetaModel{MinScore: 0.6, Z: 1.645}
+)
+
+// Decides how far a node can be trusted from its good and bad ratings
+// The same model is used for reputations of probes and credibilities of recommenders
+type ScoringModel interface {
+	// Whether a node with these ratings is trusted as a probe or as a recommender
+	Trusted(good float64, bad float64) bool
+	// Score used to weigh trusted nodes against each other, higher is better and never negative
+	Score(good float64, bad float64) float64
+}
+
+// Trust policy that judges nodes by their own ratings with a scoring model
+type ModelPolicy struct {
+	Model ScoringModel
+}
+
+func (p ModelPolicy) IsReputable(node Node) bool {
+	return IsReputable(p.Model, node)
+}
+
+func (p ModelPolicy) IsCredible(node Node) bool {
+	return IsCredible(p.Model, node)
+}
+
+func (p ModelPolicy) ProbeWeight(node Node, vouchers []Node) float64 {
+	return probeWeight(p.Model, node, vouchers)
+}
+
+// Trusts nodes that have at least Threshold more good ratings than bad ones
+type ThresholdModel struct {
+	Threshold int
+}
+
+func (m ThresholdModel) Trusted(good float64, bad float64) bool {
+	return good-bad >= float64(m.Threshold)
+}
+
+func (m ThresholdModel) Score(good float64, bad float64) float64 {
+	return math.Max(good-bad, 0)
+}
+
+// Treats ratings as evidence about the probability that the node behaves well, which has a Beta(good+1, bad+1) distribution
+// Nodes are trusted when the lower confidence bound of the probability, Z standard deviations below the expected value, reaches MinScore
+// Unlike thresholds this tells a node with a short clean history from one with a long mixed history
+type BetaModel struct {
+	MinScore float64
+	Z        float64
+}
+
+func (m BetaModel) Expected(good float64, bad float64) float64 {
+	return (good + 1) / (good + bad + 2)
+}
+
+func (m BetaModel) LowerBound(good float64, bad float64) float64 {
+	a, b := good+1, bad+1
+	variance := a * b / ((a + b) * (a + b) * (a + b + 1))
+	return math.Max(m.Expected(good, bad)-m.Z*math.Sqrt(variance), 0)
+}
+
+func (m BetaModel) Trusted(good float64, bad float64) bool {
+	return m.LowerBound(good, bad) >= m.MinScore
+}
+
+func (m BetaModel) Score(good float64, bad float64) float64 {
+	return m.LowerBound(good, bad)
+}
@@ -0,0 +1,28 @@
+package reputation
+
+import "math/rand"
+
+var DefaultSelector = RandomSelector{Quarantined: pickProbesQuarantine}
+
+// Takes all reputable probes and at most Quarantined quarantined ones, both in random order
+type RandomSelector struct {
+	Quarantined int
+}
+
+func (s RandomSelector) Select(candidates []Probe) ProbePool {
+	pool := ProbePool{Reputable: make([]Probe, 0), Quarantined: make([]Probe, 0)}
+	for _, probe := range candidates {
+		if probe.Reputable {
+			pool.Reputable = append(pool.Reputable, probe)
+		} else {
+			pool.Quarantined = append(pool.Quarantined, probe)
+		}
+	}
+	rand.Shuffle(len(pool.Reputable), func(i, j int) { pool.Reputable[i], pool.Reputable[j] = pool.Reputable[j], pool.Reputable[i] })
+	rand.Shuffle(len(pool.Quarantined), func(i, j int) { pool.Quarantined[i], pool.Quarantined[j] = pool.Quarantined[j], pool.Quarantined[i] })
+
+	if len(pool.Quarantined) > s.Quarantined {
+		pool.Quarantined = pool.Quarantined[:s.Quarantined]
+	}
+	return pool
+}
@@ -0,0 +1,103 @@
+package reputation
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rybbba/dist-pinger/fileutil"
+	"github.com/rybbba/dist-pinger/identity"
+)
+
+type nodeRecord struct {
+	Id              string    `json:"id"`
+	ReputationGood  float64   `json:"reputationgood"`
+	ReputationBad   float64   `json:"reputationbad"`
+	CredibilityGood float64   `json:"credibilitygood"`
+	CredibilityBad  float64   `json:"credibilitybad"`
+	Updated         time.Time `json:"updated"` // ratings decay from this moment, ratings without it are taken as current
+}
+
+type nodeTable struct {
+	Nodes []nodeRecord `json:"nodes"`
+	// verified key rotations, kept so that old IDs stay ignored and the first succession keeps winning after a restart
+	Successions []identity.Succession `json:"successions"`
+}
+
+// Writes the node table and known successions to the file, a crash during the write never leaves a partially written file
+func (rm *ReputationManager) SaveNodes(path string) error {
+	nodes := rm.Store.All()
+	records := make([]nodeRecord, 0, len(nodes))
+	for _, node := range nodes {
+		records = append(records, nodeRecord{
+			Id:              node.user.Id,
+			ReputationGood:  node.reputationGood,
+			ReputationBad:   node.reputationBad,
+			CredibilityGood: node.credibilityGood,
+			CredibilityBad:  node.credibilityBad,
+			Updated:         node.updated,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+	successions := rm.Successions()
+	sort.Slice(successions, func(i, j int) bool { return successions[i].OldId < successions[j].OldId })
+
+	data, err := json.Marshal(nodeTable{Nodes: records, Successions: successions})
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(path, data)
+}
+
+// Reads the node table written by SaveNodes, loaded nodes replace the known ones
+func (rm *ReputationManager) LoadNodes(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var table nodeTable
+	err = json.Unmarshal(data, &table)
+	if err != nil {
+		return err
+	}
+
+	if rm.Store == nil {
+		rm.Store = NewMemoryStore()
+	}
+	for _, record := range table.Nodes {
+		user, err := identity.ParseUser(record.Id)
+		if err != nil {
+			log.Printf("Skipping node with bad ID from %s: %v", path, err)
+			continue
+		}
+		node := nodeInit(user)
+		node.reputationGood, node.reputationBad = record.ReputationGood, record.ReputationBad
+		node.credibilityGood, node.credibilityBad = record.CredibilityGood, record.CredibilityBad
+		node.updated = record.Updated
+		if node.updated.IsZero() {
+			node.updated = time.Now()
+		}
+		rm.Store.Put(node)
+	}
+	for _, succession := range table.Successions { // checked again as the file could be edited
+		err = rm.addSuccession(succession, false)
+		if err != nil {
+			log.Printf("Skipping bad succession of %s from %s: %v", succession.OldId, path, err)
+		}
+	}
+	return nil
+}
+
+// Saves the node table to the file every interval, never returns
+func (rm *ReputationManager) FlushNodes(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := rm.SaveNodes(path)
+		if err != nil {
+			log.Printf("Cannot save nodes: %v", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package reputation
+
+import "sync"
+
+// NodeStore that keeps nodes in memory, it is persisted with SaveNodes and LoadNodes
+type MemoryStore struct {
+	nodes map[string]Node
+	mutex sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{nodes: make(map[string]Node)}
+}
+
+func (s *MemoryStore) Get(id string) (Node, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	node, ok := s.nodes[id]
+	return node, ok
+}
+
+func (s *MemoryStore) Add(node Node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.nodes[node.user.Id]; !ok {
+		s.nodes[node.user.Id] = node
+	}
+}
+
+func (s *MemoryStore) Put(node Node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nodes[node.user.Id] = node
+}
+
+func (s *MemoryStore) Update(id string, update func(Node) Node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if node, ok := s.nodes[id]; ok {
+		s.nodes[id] = update(node)
+	}
+}
+
+func (s *MemoryStore) Delete(id string) (Node, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	node, ok := s.nodes[id]
+	delete(s.nodes, id)
+	return node, ok
+}
+
+func (s *MemoryStore) All() []Node {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	nodes := make([]Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
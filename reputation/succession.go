@@ -0,0 +1,128 @@
+package reputation
+
+import (
+	"errors"
+	"log"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+	"github.com/rybbba/dist-pinger/identity"
+)
+
+var (
+	// Successions beyond this number are refused, every known succession is sent with each answer to GetReputations
+	maxSuccessions = 10000
+
+	errSuccessionLimit = errors.New("Too many successions")
+)
+
+// Verifies the succession and moves the ratings of the old ID to the new one
+// Successions of nodes we do not track are ignored, so that nobody can fill our answers with made up ones
+// The succession is kept and passed on to other nodes, later nodes with the old ID are ignored
+func (rm *ReputationManager) AddSuccession(succession identity.Succession) error {
+	return rm.addSuccession(succession, true)
+}
+
+// Successions read from our own node file are kept even though their old nodes are already gone
+func (rm *ReputationManager) addSuccession(succession identity.Succession, tracked bool) error {
+	if rm.succeeded(succession.OldId) { // the first succession wins, a stolen old key cannot redirect the reputation again
+		return nil
+	}
+	if _, ok := rm.Store.Get(succession.OldId); tracked && !ok { // checked first as it is much cheaper than the signatures
+		return nil
+	}
+	oldUser, newUser, err := succession.Verify()
+	if err != nil {
+		return err
+	}
+
+	rm.mutex.Lock()
+	if rm.successions == nil {
+		rm.successions = make(map[string]identity.Succession)
+	}
+	_, known := rm.successions[oldUser.Id] // another copy could be verified at the same time
+	full := len(rm.successions) >= maxSuccessions
+	if !known && !full {
+		rm.successions[oldUser.Id] = succession
+	}
+	rm.mutex.Unlock()
+	if known {
+		return nil
+	}
+	if full {
+		return errSuccessionLimit
+	}
+
+	oldNode, ok := rm.Store.Delete(oldUser.Id)
+	if !ok {
+		return nil
+	}
+	rm.Store.Add(nodeInit(newUser))
+	rm.Store.Update(newUser.Id, func(node Node) Node {
+		return mergeRatings(rm.current(node), rm.current(oldNode))
+	})
+	log.Printf("Node %s rotated its key, its ratings are moved to the new ID", oldUser.Address)
+	return nil
+}
+
+// Sets the succession that hands our previous ID over to our current one, it is sent with our requests
+// Our previous ID is ignored from then on, like the old IDs of other nodes
+func (rm *ReputationManager) SetPredecessor(succession identity.Succession) error {
+	_, _, err := succession.Verify()
+	if err != nil {
+		return err
+	}
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.predecessor = &succession
+	return nil
+}
+
+// Whether the ID was replaced by another one
+func (rm *ReputationManager) succeeded(id string) bool {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if rm.predecessor != nil && rm.predecessor.OldId == id {
+		return true
+	}
+	_, ok := rm.successions[id]
+	return ok
+}
+
+// All successions we know of, they are sent with every answer to GetReputations
+func (rm *ReputationManager) Successions() []identity.Succession {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	successions := make([]identity.Succession, 0, len(rm.successions))
+	for _, succession := range rm.successions {
+		successions = append(successions, succession)
+	}
+	return successions
+}
+
+// Our own succession for the requests we send, nil if we never rotated our key
+func (rm *ReputationManager) predecessorMessage() *pb.Succession {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if rm.predecessor == nil {
+		return nil
+	}
+	return SuccessionMessage(*rm.predecessor)
+}
+
+// Applies successions received from another node, invalid ones are skipped
+func (rm *ReputationManager) addSuccessions(successionMsgs []*pb.Succession) {
+	for _, successionMsg := range successionMsgs {
+		err := rm.AddSuccession(SuccessionRecord(successionMsg))
+		if err != nil {
+			log.Printf("Skipping bad succession of %s: %v", successionMsg.GetOldId(), err)
+		}
+	}
+}
+
+func SuccessionMessage(succession identity.Succession) *pb.Succession {
+	return &pb.Succession{OldId: succession.OldId, NewId: succession.NewId, Signature: succession.Signature, NewSignature: succession.NewSignature}
+}
+
+func SuccessionRecord(successionMsg *pb.Succession) identity.Succession {
+	return identity.Succession{OldId: successionMsg.GetOldId(), NewId: successionMsg.GetNewId(), Signature: successionMsg.GetSignature(), NewSignature: successionMsg.GetNewSignature()}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"regexp"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+)
+
+var (
+	maxRegexLength = 1024
+
+	errRegexLength = invalidRequest(errors.New("Assertion regex is too long"))
+)
+
+func assertionState(passed bool) pb.AssertionState {
+	if passed {
+		return pb.AssertionState_ASSERTION_PASSED
+	}
+	return pb.AssertionState_ASSERTION_FAILED
+}
+
+// Checks the response body against the requested assertions, bodies longer than maxBodySize are truncated
+func checkAssertions(assertions *pb.Assertions, body []byte) (*pb.AssertionResults, error) {
+	if assertions == nil {
+		return nil, nil
+	}
+	truncated := int64(len(body)) > maxBodySize
+	if truncated {
+		body = body[:maxBodySize]
+	}
+
+	hash := sha256.Sum256(body)
+	results := &pb.AssertionResults{BodyHash: hash[:], Truncated: truncated}
+
+	if substring := assertions.GetSubstring(); substring != "" {
+		results.Substring = assertionState(bytes.Contains(body, []byte(substring)))
+	}
+	if expr := assertions.GetRegex(); expr != "" {
+		if len(expr) > maxRegexLength {
+			return nil, errRegexLength
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, invalidRequest(err)
+		}
+		results.Regex = assertionState(re.Match(body))
+	}
+	if expected := assertions.GetBodySha256(); len(expected) > 0 {
+		results.BodySha256 = assertionState(!truncated && bytes.Equal(expected, hash[:]))
+	}
+	return results, nil
+}
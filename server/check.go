@@ -1,27 +1,218 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
-	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
 )
 
 var (
 	// Matches valid host names (and ipv4 addresses)
 	hostAddressPattern = regexp.MustCompile(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\-]*[A-Za-z0-9])$`)
-	errHostParse       = errors.New("Bad host format")
+	errHostParse       = invalidRequest(errors.New("Bad host format"))
+	errPortRange       = invalidRequest(errors.New("Port is out of range"))
+	errUrlParse        = invalidRequest(errors.New("Bad URL format"))
+	errUrlScheme       = invalidRequest(errors.New("Unsupported URL scheme"))
+
+	tcpDialTimeout       = 10 * time.Second
+	checkTimeout         = 20 * time.Second // a whole check must finish before the client gives up on the probe
+	maxBodySize    int64 = 1 << 20
+
+	tlsVersionNames = map[uint16]string{
+		tls.VersionTLS10: "TLS 1.0",
+		tls.VersionTLS11: "TLS 1.1",
+		tls.VersionTLS12: "TLS 1.2",
+		tls.VersionTLS13: "TLS 1.3",
+	}
 )
 
-func check(host string) (int, error) {
-	if !hostAddressPattern.MatchString(host) {
-		return -1, errHostParse
+// Host names, ipv4 and ipv6 addresses are valid hosts
+func validHost(host string) bool {
+	return hostAddressPattern.MatchString(host) || net.ParseIP(host) != nil
+}
+
+// Runs the check requested by the client, connections to the target are made with the given dialer
+// The check is abandoned after checkTimeout or when ctx is done, failures are reported with the response status
+func runCheck(ctx context.Context, in *pb.CheckHostRequest, dialer *net.Dialer) *pb.CheckHostResponse {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	message, err := dispatchCheck(ctx, in, dialer)
+	if err != nil {
+		if message == nil {
+			message = &pb.CheckHostResponse{}
+		}
+		message.Status = errorStatus(err)
+		return message
+	}
+	message.Status = responseStatus(message)
+	return message
+}
+
+func dispatchCheck(ctx context.Context, in *pb.CheckHostRequest, dialer *net.Dialer) (*pb.CheckHostResponse, error) {
+	switch in.GetType() {
+	case pb.CheckType_TCP:
+		tcpResult, err := checkTcp(ctx, in.GetHost(), int(in.GetPort()), dialer)
+		return &pb.CheckHostResponse{Tcp: tcpResult}, err
+	case pb.CheckType_DNS:
+		dnsResult, err := checkDns(ctx, in.GetHost(), in.GetRecordTypes())
+		return &pb.CheckHostResponse{Dns: dnsResult}, err
+	default:
+		target, err := checkUrl(in)
+		if err != nil {
+			return nil, err
+		}
+		return check(ctx, target, in.GetHttp(), in.GetAssertions(), dialer)
+	}
+}
+
+// Returns the URL requested by an HTTP(S) check, requests from older peers only contain the host
+func checkUrl(in *pb.CheckHostRequest) (*url.URL, error) {
+	if in.GetUrl() == "" {
+		if !hostAddressPattern.MatchString(in.GetHost()) {
+			return nil, errHostParse
+		}
+		scheme := "http"
+		if in.GetType() == pb.CheckType_HTTPS {
+			scheme = "https"
+		}
+		return &url.URL{Scheme: scheme, Host: in.GetHost(), Path: "/"}, nil
+	}
+
+	target, err := url.Parse(in.GetUrl())
+	if err != nil {
+		return nil, invalidRequest(err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, errUrlScheme
+	}
+	if target.Opaque != "" || target.User != nil {
+		return nil, errUrlParse
+	}
+	if !validHost(target.Hostname()) {
+		return nil, errHostParse
+	}
+	if port := target.Port(); port != "" {
+		portNum, err := strconv.Atoi(port)
+		if err != nil || portNum <= 0 || portNum > 65535 {
+			return nil, errPortRange
+		}
+	}
+	target.Fragment = "" // fragments are never sent to the server
+	return target, nil
+}
+
+func check(ctx context.Context, target *url.URL, options *pb.HttpOptions, assertions *pb.Assertions, dialer *net.Dialer) (*pb.CheckHostResponse, error) {
+	timer := newHttpTimer()
+	req, err := httpRequest(timer.trace(ctx), target, options)
+	if err != nil {
+		return nil, err
+	}
+	hops := make([]*pb.RedirectHop, 0)
+	checkRedirect, err := redirectPolicy(options, &hops)
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificates are verified in tlsInfo so that an invalid chain is reported instead of failing the whole check
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	transport.DisableKeepAlives = true
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil // the probe must connect to the target itself for the dialer to see its address
+	client := &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+
+	resp, body, err := readResponse(client, req)
+	if err != nil && timer.handshakeFailed() {
+		return nil, withStatus(pb.CheckStatus_TLS_ERROR, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	timings := timer.finish()
+	if isRedirect(resp) { // redirect was not followed
+		hops = append(hops, redirectHop(resp))
+	}
+
+	assertionResults, err := checkAssertions(assertions, body)
+	if err != nil {
+		return nil, err
+	}
+	message := &pb.CheckHostResponse{Code: int32(resp.StatusCode), Timings: timings, Assertions: assertionResults, Redirects: hops}
+	if resp.TLS != nil { // plain http resources have no TLS information
+		message.Tls = tlsInfo(resp.Request.URL.Hostname(), resp.TLS)
 	}
+	return message, nil
+}
 
-	resp, err := http.Get(fmt.Sprintf("http://%s", host))
+// Performs the request and reads the response body up to maxBodySize+1 bytes so that the caller can tell if it was truncated
+func readResponse(client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	resp, err := client.Do(req)
 	if err != nil {
-		return -1, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode, nil
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+func tlsInfo(host string, state *tls.ConnectionState) *pb.TlsInfo {
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+
+	return &pb.TlsInfo{
+		Version:      tlsVersionNames[state.Version],
+		ChainValid:   err == nil,
+		Issuer:       leaf.Issuer.String(),
+		DaysToExpiry: int32(time.Until(leaf.NotAfter).Hours() / 24),
+	}
+}
+
+func checkTcp(ctx context.Context, host string, port int, dialer *net.Dialer) (*pb.TcpResult, error) {
+	if !validHost(host) {
+		return nil, errHostParse
+	}
+	if port <= 0 || port > 65535 {
+		return nil, errPortRange
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	latency := time.Since(start)
+	if err != nil {
+		return &pb.TcpResult{Connected: false, LatencyMicros: latency.Microseconds(), Error: tcpErrorClass(err)}, err
+	}
+	conn.Close()
+	return &pb.TcpResult{Connected: true, LatencyMicros: latency.Microseconds(), Error: pb.TcpError_TCP_OK}, nil
+}
+
+func tcpErrorClass(err error) pb.TcpError {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return pb.TcpError_TCP_REFUSED
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return pb.TcpError_TCP_TIMEOUT
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return pb.TcpError_TCP_UNREACHABLE
+	default:
+		return pb.TcpError_TCP_OTHER_ERROR
+	}
 }
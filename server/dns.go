@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	resolvConfPath = "/etc/resolv.conf"
+	dnsTimeout     = 5 * time.Second
+
+	dnsRecordTypes = map[pb.DnsRecordType]dnsmessage.Type{
+		pb.DnsRecordType_A:     dnsmessage.TypeA,
+		pb.DnsRecordType_AAAA:  dnsmessage.TypeAAAA,
+		pb.DnsRecordType_CNAME: dnsmessage.TypeCNAME,
+		pb.DnsRecordType_MX:    dnsmessage.TypeMX,
+		pb.DnsRecordType_TXT:   dnsmessage.TypeTXT,
+	}
+	allDnsRecordTypes = []pb.DnsRecordType{pb.DnsRecordType_A, pb.DnsRecordType_AAAA, pb.DnsRecordType_CNAME, pb.DnsRecordType_MX, pb.DnsRecordType_TXT}
+
+	rcodeNames = map[dnsmessage.RCode]string{
+		dnsmessage.RCodeSuccess:        "NOERROR",
+		dnsmessage.RCodeFormatError:    "FORMERR",
+		dnsmessage.RCodeServerFailure:  "SERVFAIL",
+		dnsmessage.RCodeNameError:      "NXDOMAIN",
+		dnsmessage.RCodeNotImplemented: "NOTIMP",
+		dnsmessage.RCodeRefused:        "REFUSED",
+	}
+
+	errDnsRecordType = invalidRequest(errors.New("Unsupported DNS record type"))
+	errDnsMismatch   = errors.New("DNS response does not match the query")
+)
+
+// Resolves the name with the probe's system resolver, all supported record types are queried if none are given
+func checkDns(ctx context.Context, name string, recordTypes []pb.DnsRecordType) (*pb.DnsResult, error) {
+	name = strings.TrimSuffix(name, ".")
+	if !hostAddressPattern.MatchString(name) {
+		return nil, errHostParse
+	}
+	if len(recordTypes) == 0 {
+		recordTypes = allDnsRecordTypes
+	}
+	for _, recordType := range recordTypes {
+		if _, ok := dnsRecordTypes[recordType]; !ok {
+			return nil, errDnsRecordType
+		}
+	}
+
+	fqdn, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, invalidRequest(err)
+	}
+	resolver := systemResolver()
+
+	result := &pb.DnsResult{Answers: make([]*pb.DnsAnswer, 0, len(recordTypes))}
+	for _, recordType := range recordTypes {
+		answer, err := queryDns(ctx, resolver, fqdn, recordType)
+		if err != nil {
+			return nil, withStatus(pb.CheckStatus_DNS_FAILURE, err)
+		}
+		result.Answers = append(result.Answers, answer)
+	}
+	return result, nil
+}
+
+func systemResolver() string {
+	fi, err := os.Open(resolvConfPath)
+	if err == nil {
+		defer fi.Close()
+		scanner := bufio.NewScanner(fi)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func queryDns(ctx context.Context, resolver string, name dnsmessage.Name, recordType pb.DnsRecordType) (*pb.DnsAnswer, error) {
+	qtype, ok := dnsRecordTypes[recordType]
+	if !ok {
+		return nil, errDnsRecordType
+	}
+
+	var idBytes [2]byte // an unpredictable ID makes spoofed answers harder to inject
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	question := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeDns(ctx, "udp", resolver, packed)
+	if err == nil && resp.Header.Truncated { // answer does not fit into a datagram
+		resp, err = exchangeDns(ctx, "tcp", resolver, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.ID != id || !resp.Header.Response || !sameQuestion(resp.Questions, question) {
+		return nil, errDnsMismatch
+	}
+
+	answer := &pb.DnsAnswer{Type: recordType, Rcode: rcodeName(resp.Header.RCode), Records: make([]*pb.DnsRecord, 0, len(resp.Answers))}
+	for _, resource := range resp.Answers {
+		record := dnsRecord(resource)
+		if record != nil {
+			answer.Records = append(answer.Records, record)
+		}
+	}
+	sort.Slice(answer.Records, func(i, j int) bool {
+		if answer.Records[i].Type != answer.Records[j].Type {
+			return answer.Records[i].Type < answer.Records[j].Type
+		}
+		return answer.Records[i].Value < answer.Records[j].Value
+	})
+	return answer, nil
+}
+
+// The response must repeat the question of the query, names are compared case-insensitively
+func sameQuestion(questions []dnsmessage.Question, question dnsmessage.Question) bool {
+	return len(questions) == 1 && questions[0].Type == question.Type && questions[0].Class == question.Class &&
+		strings.EqualFold(questions[0].Name.String(), question.Name.String())
+}
+
+func exchangeDns(ctx context.Context, network string, resolver string, packed []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var buf []byte
+	if network == "tcp" { // messages are prefixed with their length in stream transports
+		_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+		if err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err = conn.Write(packed); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 1232)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var resp dnsmessage.Message
+	err = resp.Unpack(buf)
+	return &resp, err
+}
+
+// Converts a resource from the answer section to a record, resources of unsupported types are skipped
+func dnsRecord(resource dnsmessage.Resource) *pb.DnsRecord {
+	record := &pb.DnsRecord{Ttl: resource.Header.TTL}
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		record.Type, record.Value = pb.DnsRecordType_A, net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		record.Type, record.Value = pb.DnsRecordType_AAAA, net.IP(body.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		record.Type, record.Value = pb.DnsRecordType_CNAME, body.CNAME.String()
+	case *dnsmessage.MXResource:
+		record.Type, record.Value = pb.DnsRecordType_MX, fmt.Sprintf("%d %s", body.Pref, body.MX.String())
+	case *dnsmessage.TXTResource:
+		record.Type, record.Value = pb.DnsRecordType_TXT, strings.Join(body.TXT, "")
+	default:
+		return nil
+	}
+	return record
+}
+
+func rcodeName(rcode dnsmessage.RCode) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return rcode.String()
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+)
+
+var (
+	// Only methods that probes send without a request body and headers that do not change how the probe reads the response are allowed
+	allowedMethods = map[string]bool{
+		http.MethodGet:  true,
+		http.MethodHead: true,
+		http.MethodPost: true,
+	}
+	allowedHeaders = map[string]bool{
+		"Host":            true,
+		"User-Agent":      true,
+		"Accept":          true,
+		"Accept-Language": true,
+		"Cache-Control":   true,
+	}
+	maxHeaders           = 16
+	maxHeaderValueLength = 256
+
+	defaultMaxRedirects = 10
+	maxRedirects        = 10
+
+	errMethodNotAllowed = invalidRequest(errors.New("HTTP method is not allowed"))
+	errHeaderNotAllowed = invalidRequest(errors.New("HTTP header is not allowed"))
+	errHeaderValue      = invalidRequest(errors.New("HTTP header value is too long"))
+	errTooManyHeaders   = invalidRequest(errors.New("Too many HTTP headers"))
+	errRedirectLimit    = invalidRequest(errors.New("Redirect limit is out of range"))
+)
+
+// Builds the request for an HTTP(S) check, options outside of the allow-list are rejected
+func httpRequest(ctx context.Context, target *url.URL, options *pb.HttpOptions) (*http.Request, error) {
+	method := options.GetMethod()
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !allowedMethods[method] {
+		return nil, errMethodNotAllowed
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, invalidRequest(err)
+	}
+
+	if len(options.GetHeaders()) > maxHeaders {
+		return nil, errTooManyHeaders
+	}
+	for _, header := range options.GetHeaders() {
+		name := http.CanonicalHeaderKey(header.GetName())
+		if !allowedHeaders[name] {
+			return nil, errHeaderNotAllowed
+		}
+		if len(header.GetValue()) > maxHeaderValueLength {
+			return nil, errHeaderValue
+		}
+		if name == "Host" {
+			req.Host = header.GetValue()
+		} else {
+			req.Header.Set(name, header.GetValue())
+		}
+	}
+	return req, nil
+}
+
+// Returns a redirect policy for http.Client which records every redirect response to hops
+// Redirects which are not followed are not treated as errors so the last redirect response becomes the check result
+func redirectPolicy(options *pb.HttpOptions, hops *[]*pb.RedirectHop) (func(req *http.Request, via []*http.Request) error, error) {
+	limit := int(options.GetMaxRedirects())
+	if limit < 0 || limit > maxRedirects {
+		return nil, errRedirectLimit
+	}
+	if limit == 0 {
+		limit = defaultMaxRedirects
+	}
+	if options.GetRedirectPolicy() == pb.RedirectPolicy_REDIRECT_NONE {
+		limit = 0
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > limit {
+			return http.ErrUseLastResponse
+		}
+		*hops = append(*hops, redirectHop(req.Response))
+		return nil
+	}, nil
+}
+
+func redirectHop(resp *http.Response) *pb.RedirectHop {
+	return &pb.RedirectHop{Code: int32(resp.StatusCode), Location: resp.Header.Get("Location")}
+}
+
+func isRedirect(resp *http.Response) bool {
+	return resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get("Location") != ""
+}
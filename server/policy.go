@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+)
+
+var (
+	// Probes refuse to connect to these networks unless the operator allows them explicitly
+	restrictedNetworks = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/8"),      // "this" network, reaches the local host
+		netip.MustParsePrefix("10.0.0.0/8"),     // RFC1918
+		netip.MustParsePrefix("100.64.0.0/10"),  // CGNAT
+		netip.MustParsePrefix("127.0.0.0/8"),    // loopback
+		netip.MustParsePrefix("169.254.0.0/16"), // link-local, includes cloud metadata services
+		netip.MustParsePrefix("172.16.0.0/12"),  // RFC1918
+		netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+		netip.MustParsePrefix("192.168.0.0/16"), // RFC1918
+		netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+		netip.MustParsePrefix("224.0.0.0/4"),    // multicast
+		netip.MustParsePrefix("240.0.0.0/4"),    // reserved, includes broadcast
+		netip.MustParsePrefix("::/128"),         // unspecified
+		netip.MustParsePrefix("::1/128"),        // loopback
+		netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64, the embedded IPv4 address is not defined
+		netip.MustParsePrefix("2001::/32"),      // Teredo, the embedded IPv4 address is obfuscated
+		netip.MustParsePrefix("fc00::/7"),       // unique local, includes fd00:ec2::254 metadata service
+		netip.MustParsePrefix("fe80::/10"),      // link-local
+		netip.MustParsePrefix("fec0::/10"),      // site-local
+		netip.MustParsePrefix("ff00::/8"),       // multicast
+	}
+
+	// Addresses in these networks reach the IPv4 address embedded in them, they are judged by that address
+	nat64Network      = netip.MustParsePrefix("64:ff9b::/96") // IPv4 address in the last 32 bits on NAT64 hosts
+	ipv4CompatNetwork = netip.MustParsePrefix("::/96")        // deprecated IPv4-compatible addresses, IPv4 address in the last 32 bits
+	sixToFourNetwork  = netip.MustParsePrefix("2002::/16")    // 6to4, IPv4 address in the 32 bits after the prefix
+
+	errPolicyRefused = withStatus(pb.CheckStatus_POLICY_REFUSED, errors.New("Target address is refused by the probe policy"))
+)
+
+type addressPolicy struct {
+	allowed []netip.Prefix
+}
+
+func (p addressPolicy) permits(addr netip.Addr) bool {
+	addr = embeddedIpv4(addr.Unmap())
+	for _, prefix := range p.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	for _, prefix := range restrictedNetworks {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the IPv4 address embedded in an IPv6 address that leads to it, other addresses are returned as they are
+func embeddedIpv4(addr netip.Addr) netip.Addr {
+	bytes := addr.As16()
+	switch {
+	case nat64Network.Contains(addr), ipv4CompatNetwork.Contains(addr):
+		return netip.AddrFrom4([4]byte{bytes[12], bytes[13], bytes[14], bytes[15]})
+	case sixToFourNetwork.Contains(addr):
+		return netip.AddrFrom4([4]byte{bytes[2], bytes[3], bytes[4], bytes[5]})
+	}
+	return addr
+}
+
+// Returns a dialer that refuses connections to restricted addresses
+// Addresses are checked after name resolution so that redirects and DNS rebinding are covered as well
+func (p addressPolicy) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: tcpDialTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !p.permits(addrPort.Addr()) {
+				return errPolicyRefused
+			}
+			return nil
+		},
+	}
+}
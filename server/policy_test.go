@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAddressPolicyPermits(t *testing.T) {
+	tests := []struct {
+		addr    string
+		permits bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"169.254.169.254", false},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"224.0.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"fec0::1", false},
+		{"ff02::1", false},
+		// IPv6 addresses that lead to an embedded IPv4 address are judged by it
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::808:808", true},
+		{"64:ff9b:1::1", false},
+		{"::7f00:1", false},
+		{"::808:808", true},
+		{"2002:7f00:1::1", false},
+		{"2002:a9fe:a9fe::1", false},
+		{"2002:808:808::1", true},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+	}
+
+	policy := addressPolicy{}
+	for _, test := range tests {
+		if got := policy.permits(netip.MustParseAddr(test.addr)); got != test.permits {
+			t.Errorf("permits(%s) = %t, want %t", test.addr, got, test.permits)
+		}
+	}
+}
+
+func TestAddressPolicyAllowed(t *testing.T) {
+	policy := addressPolicy{allowed: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	for _, addr := range []string{"10.1.2.3", "64:ff9b::a01:203", "2002:a01:203::1"} {
+		if !policy.permits(netip.MustParseAddr(addr)) {
+			t.Errorf("permits(%s) = false for an allowed network", addr)
+		}
+	}
+	if policy.permits(netip.MustParseAddr("127.0.0.1")) {
+		t.Errorf("permits(127.0.0.1) = true outside of the allowed network")
+	}
+}
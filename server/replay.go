@@ -0,0 +1,119 @@
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rybbba/dist-pinger/identity"
+)
+
+var (
+	minNonceSize     = 16
+	nonceCacheSize   = 100000
+	nonceSenderQuota = 2000 // unexpired nonces of a single sender, keeps one node from filling the whole cache
+
+	errRequestRecipient = errors.New("Request is meant for another node")
+	errRequestExpired   = errors.New("Request is expired or not valid yet")
+	errRequestLifetime  = errors.New("Request lifetime is too long")
+	errRequestNonce     = errors.New("Request nonce is too short")
+	errRequestReplayed  = errors.New("Request was already received")
+	errRequestForgotten = errors.New("Request is too old for the current load, send a new one")
+	errNonceQuota       = errors.New("Too many requests from the sender, try again later")
+)
+
+type nonceEntry struct {
+	sender string
+	key    string
+	issued time.Time
+}
+
+// Nonce entries ordered by the moment their requests were issued, the earliest first
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].issued.Before(h[j].issued) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(nonceEntry)) }
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// Remembers nonces of accepted requests until the requests expire
+// When the cache is full the nonce of the oldest request is forgotten and requests issued no later than it are refused from then on,
+// so flooding the cache only costs honest nodes their requests that are older than the flood can keep in the cache
+type nonceCache struct {
+	seen     map[string]bool // by sender and nonce
+	bySender map[string]int  // number of remembered nonces of every sender
+	issued   nonceHeap
+	cutoff   time.Time // requests issued until this moment may have been forgotten
+	mutex    sync.Mutex
+}
+
+func (c *nonceCache) forget() nonceEntry {
+	entry := heap.Pop(&c.issued).(nonceEntry)
+	delete(c.seen, entry.key)
+	c.bySender[entry.sender]--
+	if c.bySender[entry.sender] == 0 {
+		delete(c.bySender, entry.sender)
+	}
+	return entry
+}
+
+func (c *nonceCache) add(sender string, nonce []byte, issued time.Time, now time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]bool)
+		c.bySender = make(map[string]int)
+	}
+	// requests issued before now-RequestLifetime are expired, they are refused without looking at the nonce
+	for len(c.issued) > 0 && now.After(c.issued[0].issued.Add(identity.RequestLifetime)) {
+		c.forget()
+	}
+
+	key := sender + "#" + string(nonce)
+	if c.seen[key] {
+		return errRequestReplayed
+	}
+	if !issued.After(c.cutoff) {
+		return errRequestForgotten
+	}
+	if c.bySender[sender] >= nonceSenderQuota {
+		return errNonceQuota
+	}
+	if len(c.seen) >= nonceCacheSize {
+		if !issued.After(c.issued[0].issued) { // the request itself is the oldest one
+			return errRequestForgotten
+		}
+		c.cutoff = c.forget().issued
+	}
+	c.seen[key] = true
+	c.bySender[sender]++
+	heap.Push(&c.issued, nonceEntry{sender: sender, key: key, issued: issued})
+	return nil
+}
+
+// Rejects requests that are meant for another node, are outside of their validity window or were already received
+// Must be called after the signature of the request is verified
+func (s *PingerServer) checkReplay(sender string, recipient string, issuedAt int64, expiresAt int64, nonce []byte) error {
+	if recipient != s.user.Id {
+		return errRequestRecipient
+	}
+	now := time.Now()
+	issued, expires := time.UnixMilli(issuedAt), time.UnixMilli(expiresAt)
+	if now.Add(identity.ClockSkew).Before(issued) || now.After(expires) {
+		return errRequestExpired
+	}
+	if expires.Sub(issued) > identity.RequestLifetime {
+		return errRequestLifetime
+	}
+	if len(nonce) < minNonceSize {
+		return errRequestNonce
+	}
+	return s.nonces.add(sender, nonce, issued, now)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rybbba/dist-pinger/identity"
+)
+
+func withNonceLimits(t *testing.T, cacheSize int, senderQuota int) {
+	oldSize, oldQuota := nonceCacheSize, nonceSenderQuota
+	nonceCacheSize, nonceSenderQuota = cacheSize, senderQuota
+	t.Cleanup(func() { nonceCacheSize, nonceSenderQuota = oldSize, oldQuota })
+}
+
+func TestNonceCacheReplay(t *testing.T) {
+	var c nonceCache
+	now := time.Now()
+	if err := c.add("a", []byte("nonce"), now, now); err != nil {
+		t.Fatalf("first request refused: %v", err)
+	}
+	if err := c.add("a", []byte("nonce"), now, now); err != errRequestReplayed {
+		t.Fatalf("replayed request: got %v, want %v", err, errRequestReplayed)
+	}
+	if err := c.add("b", []byte("nonce"), now, now); err != nil {
+		t.Fatalf("same nonce of another sender refused: %v", err)
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	var c nonceCache
+	now := time.Now()
+	c.add("a", []byte("old"), now, now)
+	c.add("a", []byte("new"), now.Add(identity.RequestLifetime), now.Add(identity.RequestLifetime))
+
+	later := now.Add(identity.RequestLifetime + time.Second)
+	if err := c.add("b", []byte("x"), later, later); err != nil {
+		t.Fatalf("request refused: %v", err)
+	}
+	if len(c.seen) != 2 || c.bySender["a"] != 1 {
+		t.Fatalf("expired nonce kept: %d nonces, %d of sender a", len(c.seen), c.bySender["a"])
+	}
+	if !c.cutoff.IsZero() {
+		t.Fatalf("cutoff moved by expiry: %v", c.cutoff)
+	}
+}
+
+func TestNonceCacheSenderQuota(t *testing.T) {
+	withNonceLimits(t, 100, 3)
+	var c nonceCache
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.add("a", []byte(fmt.Sprint(i)), now, now); err != nil {
+			t.Fatalf("request %d refused: %v", i, err)
+		}
+	}
+	if err := c.add("a", []byte("3"), now, now); err != errNonceQuota {
+		t.Fatalf("request over quota: got %v, want %v", err, errNonceQuota)
+	}
+	if err := c.add("b", []byte("0"), now, now); err != nil {
+		t.Fatalf("request of another sender refused: %v", err)
+	}
+}
+
+func TestNonceCacheFull(t *testing.T) {
+	withNonceLimits(t, 4, 2)
+	var c nonceCache
+	start := time.Now()
+	// a flood from many senders fills the cache
+	for i := 0; i < 4; i++ {
+		issued := start.Add(time.Duration(i) * time.Millisecond)
+		if err := c.add(fmt.Sprint("flood", i), []byte("x"), issued, issued); err != nil {
+			t.Fatalf("flood request %d refused: %v", i, err)
+		}
+	}
+
+	// a fresh request still gets in, the oldest nonce is forgotten
+	now := start.Add(10 * time.Millisecond)
+	if err := c.add("honest", []byte("x"), now, now); err != nil {
+		t.Fatalf("fresh request refused: %v", err)
+	}
+	if len(c.seen) != 4 || c.seen["flood0#x"] {
+		t.Fatalf("oldest nonce kept")
+	}
+	if !c.cutoff.Equal(start) {
+		t.Fatalf("cutoff: got %v, want %v", c.cutoff, start)
+	}
+
+	// the forgotten request cannot be replayed
+	if err := c.add("flood0", []byte("x"), start, now); err != errRequestForgotten {
+		t.Fatalf("replay of forgotten request: got %v, want %v", err, errRequestForgotten)
+	}
+	// a request older than everything in the full cache is refused instead of pushing newer nonces out
+	old := start.Add(time.Millisecond / 2)
+	if err := c.add("late", []byte("x"), old, now); err != errRequestForgotten {
+		t.Fatalf("old request: got %v, want %v", err, errRequestForgotten)
+	}
+	if !c.seen["flood1#x"] {
+		t.Fatalf("newer nonce forgotten for an older request")
+	}
+}
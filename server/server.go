@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"net/netip"
+	"time"
 
 	pb "github.com/rybbba/dist-pinger/grpc"
 	"github.com/rybbba/dist-pinger/identity"
@@ -16,6 +19,8 @@ import (
 type PingerServer struct {
 	RepManager reputation.ReputationManagerInterface
 	user       identity.PrivateUser
+	policy     addressPolicy
+	nonces     nonceCache
 	pb.UnimplementedPingerServer
 	pb.UnimplementedReputationServer
 }
@@ -24,6 +29,11 @@ func (s *PingerServer) SetUser(user identity.PrivateUser) {
 	s.user = user
 }
 
+// Allows checks of targets in the given networks even if they are restricted by default (e.g. private or loopback networks)
+func (s *PingerServer) SetAllowedNetworks(networks []netip.Prefix) {
+	s.policy = addressPolicy{allowed: networks}
+}
+
 func (s *PingerServer) GetReputations(ctx context.Context, in *pb.GetReputationsRequest) (*pb.GetReputationsResponse, error) {
 	sender := in.GetSender()
 	senderUser, err := identity.ParseUser(sender)
@@ -36,10 +46,28 @@ func (s *PingerServer) GetReputations(ctx context.Context, in *pb.GetReputations
 	if err != nil {
 		return &pb.GetReputationsResponse{}, err
 	}
+	err = s.checkReplay(sender, in.GetRecipient(), in.GetIssuedAt(), in.GetExpiresAt(), in.GetNonce())
+	if err != nil {
+		return &pb.GetReputationsResponse{}, err
+	}
+
+	if in.GetSuccession() != nil {
+		if in.GetSuccession().GetNewId() != sender {
+			log.Printf("Ignoring succession sent by another node")
+		} else if err := s.RepManager.AddSuccession(reputation.SuccessionRecord(in.GetSuccession())); err != nil {
+			log.Printf("Ignoring bad succession of %s: %v", senderUser.Address, err)
+		}
+	}
 
 	needCredibilities := in.GetNeedCredibilities()
 
-	messageP := s.RepManager.GiveProbes(senderUser, needCredibilities)
+	messageP := &pb.GetReputationsResponse{Probes: make([]*pb.Probe, 0)}
+	for _, node := range s.RepManager.GiveNodes(senderUser) {
+		messageP.Probes = append(messageP.Probes, probeMessage(node, needCredibilities))
+	}
+	for _, succession := range s.RepManager.Successions() {
+		messageP.Successions = append(messageP.Successions, reputation.SuccessionMessage(succession))
+	}
 	signature, err = identity.SignProto(s.user, messageP)
 	if err != nil {
 		log.Fatalf("cannot sign message: %v", err)
@@ -48,6 +76,50 @@ func (s *PingerServer) GetReputations(ctx context.Context, in *pb.GetReputations
 	return messageP, nil
 }
 
+func (s *PingerServer) GetTrust(ctx context.Context, in *pb.GetTrustRequest) (*pb.GetTrustResponse, error) {
+	sender := in.GetSender()
+	senderUser, err := identity.ParseUser(sender)
+	if err != nil {
+		return &pb.GetTrustResponse{}, err
+	}
+	signature := in.Signature
+	in.Signature = nil
+	err = identity.VerifyProto(senderUser, in, signature)
+	if err != nil {
+		return &pb.GetTrustResponse{}, err
+	}
+	err = s.checkReplay(sender, in.GetRecipient(), in.GetIssuedAt(), in.GetExpiresAt(), in.GetNonce())
+	if err != nil {
+		return &pb.GetTrustResponse{}, err
+	}
+
+	message := &pb.GetTrustResponse{Trusts: make([]*pb.Trust, 0)}
+	for id, value := range s.RepManager.LocalTrust() {
+		message.Trusts = append(message.Trusts, &pb.Trust{Id: id, Value: value})
+	}
+	signature, err = identity.SignProto(s.user, message)
+	if err != nil {
+		log.Fatalf("cannot sign message: %v", err)
+	}
+	message.Signature = signature
+	return message, nil
+}
+
+// Ratings are sent to peers as whole numbers
+func probeMessage(node reputation.Node, withCredibility bool) *pb.Probe {
+	reputationGood, reputationBad := node.Reputation()
+	probeMsg := &pb.Probe{Id: node.User().Id, ReputationGood: rating(reputationGood), ReputationBad: rating(reputationBad)}
+	if withCredibility {
+		credibilityGood, credibilityBad := node.Credibility()
+		probeMsg.CredibilityGood, probeMsg.CredibilityBad = rating(credibilityGood), rating(credibilityBad)
+	}
+	return probeMsg
+}
+
+func rating(value float64) int32 {
+	return int32(math.Round(value))
+}
+
 func (s *PingerServer) CheckHost(ctx context.Context, in *pb.CheckHostRequest) (*pb.CheckHostResponse, error) {
 	sender := in.GetSender()
 	senderUser, err := identity.ParseUser(sender)
@@ -60,19 +132,25 @@ func (s *PingerServer) CheckHost(ctx context.Context, in *pb.CheckHostRequest) (
 	if err != nil {
 		return &pb.CheckHostResponse{}, err
 	}
+	err = s.checkReplay(sender, in.GetRecipient(), in.GetIssuedAt(), in.GetExpiresAt(), in.GetNonce())
+	if err != nil {
+		return &pb.CheckHostResponse{}, err
+	}
 
-	res, err := check(in.GetHost())
+	requestHash, err := identity.HashProto(in) // the signature is already cleared
 	if err != nil {
-		return &pb.CheckHostResponse{Code: -1}, err // TODO: probably should not return all server-side errors to client
+		return &pb.CheckHostResponse{}, err
 	}
 
-	message := pb.CheckHostResponse{Code: int32(res)}
-	signature, err = identity.SignProto(s.user, &message)
+	checkedAt := time.Now()
+	message := runCheck(ctx, in, s.policy.dialer())
+	message.RequestHash, message.Host, message.CheckedAt = requestHash, in.GetHost(), checkedAt.UnixMilli()
+	signature, err = identity.SignProto(s.user, message)
 	if err != nil {
 		log.Fatalf("cannot sign message: %v", err)
 	}
 	message.Signature = signature
-	return &message, nil
+	return message, nil
 }
 
 func (pingerServer *PingerServer) Serve(port int) {
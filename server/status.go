@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+)
+
+// Error that knows which status should be reported to the client
+type statusError struct {
+	status pb.CheckStatus
+	err    error
+}
+
+func (e statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e statusError) Unwrap() error {
+	return e.err
+}
+
+func withStatus(status pb.CheckStatus, err error) error {
+	return statusError{status: status, err: err}
+}
+
+// Errors caused by a malformed or disallowed check request
+func invalidRequest(err error) error {
+	return withStatus(pb.CheckStatus_INVALID_REQUEST, err)
+}
+
+// Maps an error encountered during a check to the status reported to the client
+func errorStatus(err error) pb.CheckStatus {
+	var statusErr statusError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.status
+	case errors.As(err, &dnsErr):
+		return pb.CheckStatus_DNS_FAILURE
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return pb.CheckStatus_CONNECT_TIMEOUT
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return pb.CheckStatus_CONNECT_ERROR
+	default:
+		return pb.CheckStatus_CHECK_FAILED
+	}
+}
+
+// Status of a completed check
+func responseStatus(message *pb.CheckHostResponse) pb.CheckStatus {
+	if message.GetCode() >= 400 {
+		return pb.CheckStatus_HTTP_ERROR
+	}
+	return pb.CheckStatus_OK
+}
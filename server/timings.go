@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	pb "github.com/rybbba/dist-pinger/grpc"
+)
+
+// Collects durations of request phases, phases repeated during redirects are summed up
+type httpTimer struct {
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	timings      pb.Timings
+	tlsFailed    bool
+
+	mutex sync.Mutex // connection attempts to several addresses may run in parallel
+}
+
+func newHttpTimer() *httpTimer {
+	return &httpTimer{start: time.Now()}
+}
+
+func (t *httpTimer) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.add(&t.timings.DnsMicros, &t.dnsStart) },
+
+		ConnectStart: func(string, string) { t.mark(&t.connectStart) },
+		ConnectDone:  func(string, string, error) { t.add(&t.timings.ConnectMicros, &t.connectStart) },
+
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			t.add(&t.timings.TlsMicros, &t.tlsStart)
+			if err != nil {
+				t.mutex.Lock()
+				t.tlsFailed = true
+				t.mutex.Unlock()
+			}
+		},
+
+		GotFirstResponseByte: func() {
+			t.mutex.Lock()
+			t.timings.TtfbMicros = time.Since(t.start).Microseconds()
+			t.mutex.Unlock()
+		},
+	})
+}
+
+func (t *httpTimer) mark(moment *time.Time) {
+	t.mutex.Lock()
+	*moment = time.Now()
+	t.mutex.Unlock()
+}
+
+func (t *httpTimer) add(total *int64, since *time.Time) {
+	t.mutex.Lock()
+	*total += time.Since(*since).Microseconds()
+	t.mutex.Unlock()
+}
+
+func (t *httpTimer) handshakeFailed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.tlsFailed
+}
+
+// Returns collected timings with the total duration measured up to this moment
+func (t *httpTimer) finish() *pb.Timings {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return &pb.Timings{
+		DnsMicros:     t.timings.DnsMicros,
+		ConnectMicros: t.timings.ConnectMicros,
+		TlsMicros:     t.timings.TlsMicros,
+		TtfbMicros:    t.timings.TtfbMicros,
+		TotalMicros:   time.Since(t.start).Microseconds(),
+	}
+}